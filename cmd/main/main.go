@@ -2,18 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	_ "time/tzdata"
 
+	"github.com/dorik33/cloud/internal/acl"
+	"github.com/dorik33/cloud/internal/auth"
+	"github.com/dorik33/cloud/internal/ban"
 	"github.com/dorik33/cloud/internal/config"
 	"github.com/dorik33/cloud/internal/handlers"
 	"github.com/dorik33/cloud/internal/loadbalancer"
+	"github.com/dorik33/cloud/internal/problem"
 	"github.com/dorik33/cloud/internal/ratelimit"
 	"github.com/dorik33/cloud/internal/store"
+	"github.com/dorik33/cloud/internal/usage"
 )
 
 func main() {
@@ -33,16 +42,44 @@ func main() {
 	}
 	defer store.Close()
 
-	clientHandler := handlers.NewClientHandler(store.ClientRepository, cfg)
-	rateLimiter := ratelimit.NewRateLimiter(store.ClientRepository)
-	serverPool := loadbalancer.NewServerPool(rateLimiter)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	rateLimiter, err := ratelimit.NewRateLimiter(store.ClientRepository, store.QuotaRepository, store.ShadowRepository, cfg.RateLimit)
+	if err != nil {
+		slog.Error("Failed to initialize rate limiter", "error", err)
+		os.Exit(1)
+	}
+	if err := rateLimiter.Start(ctx); err != nil {
+		slog.Error("Failed to start rate limiter", "error", err)
+		os.Exit(1)
+	}
+	usageRecorder := usage.NewRecorder(store.UsageRepository, cfg.RateLimit.FlushInterval)
+	usageRecorder.Start(ctx)
+	accessList := acl.NewACL(store.ACLRepository)
+	if err := accessList.Load(ctx); err != nil {
+		slog.Error("Failed to load acl", "error", err)
+		os.Exit(1)
+	}
+	accessList.Start(ctx, cfg.ACL.ReloadInterval)
+	clientHandler := handlers.NewClientHandler(store.ClientRepository, store.QuotaRepository, store.PlanRepository, rateLimiter, accessList, cfg)
+	idempotency := handlers.NewIdempotency(store.IdempotencyRepository, cfg.Idempotency)
+	idempotency.Start(ctx)
+	planHandler := handlers.NewPlanHandler(store.PlanRepository, rateLimiter, cfg)
+	aclHandler := handlers.NewACLHandler(store.ACLRepository, accessList)
+	shadowHandler := handlers.NewShadowHandler(store.ShadowRepository)
+	usageHandler := handlers.NewUsageHandler(store.ClientRepository, store.UsageRepository)
+	jail := ban.NewJail(cfg.Bans)
+	jail.Start(ctx)
+	banHandler := handlers.NewBanHandler(jail)
+	serverPool := loadbalancer.NewServerPool(rateLimiter, accessList, usageRecorder, jail)
 	for _, backendUrl := range cfg.Backends {
 		u, err := url.Parse(backendUrl)
 		if err != nil {
 			slog.Error("Invalid URL", "url", backendUrl, "error", err)
 			os.Exit(1)
 		}
-		serverPool.AddBackend(u)
+		serverPool.AddBackend(u, ratelimit.NewCeiling(cfg.Ceilings.BackendCeiling(backendUrl)))
 	}
 
 	go func() {
@@ -60,25 +97,84 @@ func main() {
 	serverPool.HealthCheck()
 	serverPool.StartHealthCheck(1 * time.Minute)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	rateLimiter.StartRefillTicker(ctx)
+	authenticator := auth.NewAuthenticator(store.AdminTokenRepository, cfg.Admin)
+	adminTokenHandler := handlers.NewAdminTokenHandler(store.AdminTokenRepository)
+	viewer := authenticator.Require(auth.RoleViewer)
+	operator := authenticator.Require(auth.RoleOperator)
+	admin := authenticator.Require(auth.RoleAdmin)
+
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("GET /clients", viewer(clientHandler.GetClientsHandler))
+	adminMux.HandleFunc("POST /clients", operator(idempotency.Wrap(clientHandler.CreateClientHandler)))
+	adminMux.HandleFunc("POST /clients:bulk", operator(clientHandler.BulkImportHandler))
+	adminMux.HandleFunc("GET /clients:export", viewer(clientHandler.ExportClientsHandler))
+	adminMux.HandleFunc("GET /clients/{client_id}", viewer(clientHandler.GetClientHandler))
+	adminMux.HandleFunc("PUT /clients/{client_id}", operator(clientHandler.UpdateClientHandler))
+	adminMux.HandleFunc("PATCH /clients/{client_id}", operator(clientHandler.PatchClientHandler))
+	adminMux.HandleFunc("POST /clients/{client_id}/tokens", operator(clientHandler.TokensHandler))
+	adminMux.HandleFunc("DELETE /clients/{client_id}", admin(clientHandler.DeleteClientHandler))
+	adminMux.HandleFunc("PUT /clients/{client_id}/quotas/{period}", operator(clientHandler.SetQuotaHandler))
+	adminMux.HandleFunc("DELETE /clients/{client_id}/quotas/{period}", operator(clientHandler.DeleteQuotaHandler))
+	adminMux.HandleFunc("GET /clients/{client_id}/usage", viewer(usageHandler.GetClientUsageHandler))
+	adminMux.HandleFunc("GET /usage/export", viewer(usageHandler.ExportUsageHandler))
+	adminMux.HandleFunc("GET /plans", viewer(planHandler.GetPlansHandler))
+	adminMux.HandleFunc("POST /plans", admin(planHandler.CreatePlanHandler))
+	adminMux.HandleFunc("GET /plans/{plan_id}", viewer(planHandler.GetPlanHandler))
+	adminMux.HandleFunc("PUT /plans/{plan_id}", admin(planHandler.UpdatePlanHandler))
+	adminMux.HandleFunc("DELETE /plans/{plan_id}", admin(planHandler.DeletePlanHandler))
+	adminMux.HandleFunc("GET /acl", viewer(aclHandler.GetRulesHandler))
+	adminMux.HandleFunc("POST /acl", admin(aclHandler.CreateRuleHandler))
+	adminMux.HandleFunc("DELETE /acl/{id}", admin(aclHandler.DeleteRuleHandler))
+	adminMux.HandleFunc("GET /bans", viewer(banHandler.GetBansHandler))
+	adminMux.HandleFunc("DELETE /bans/{kind}/{subject}", operator(banHandler.LiftBanHandler))
+	adminMux.HandleFunc("GET /shadow-denials", viewer(shadowHandler.GetDenialsHandler))
+	adminMux.HandleFunc("GET /admin/tokens", admin(adminTokenHandler.GetTokensHandler))
+	adminMux.HandleFunc("POST /admin/tokens", admin(adminTokenHandler.CreateTokenHandler))
+	adminMux.HandleFunc("GET /admin/tokens/{id}", admin(adminTokenHandler.GetTokenHandler))
+	adminMux.HandleFunc("PUT /admin/tokens/{id}", admin(adminTokenHandler.UpdateTokenHandler))
+	adminMux.HandleFunc("DELETE /admin/tokens/{id}", admin(adminTokenHandler.DeleteTokenHandler))
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /clients", clientHandler.GetClientsHandler)
-	mux.HandleFunc("POST /clients", clientHandler.CreateClientHandler)
-	mux.Handle("PUT /clients/{client_id}", http.HandlerFunc(clientHandler.UpdateClientHandler))
-	mux.Handle("DELETE /clients/{client_id}", http.HandlerFunc(clientHandler.DeleteClientHandler))
 	mux.HandleFunc("/", serverPool.LoadBalance)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%s", cfg.Port),
-		Handler: mux,
+		Handler: problem.WithRequestID(loadbalancer.LimitGlobal(ratelimit.NewCeiling(cfg.Ceilings.Global), mux)),
 	}
-	slog.Debug("Starting load balancer", "port", cfg.Port)
+	adminServer := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.Admin.Port),
+		Handler: problem.WithRequestID(adminMux),
+	}
+	slog.Debug("Starting load balancer", "port", cfg.Port, "admin_port", cfg.Admin.Port)
 
-	if err := server.ListenAndServe(); err != nil {
-		slog.Error("Server failed", "error", err)
-		os.Exit(1)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+	go func() {
+		if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Admin server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down server", "error", err)
+	}
+	if err := adminServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to shut down admin server", "error", err)
+	}
+	if err := rateLimiter.Close(shutdownCtx); err != nil {
+		slog.Error("Failed to flush rate limiter", "error", err)
+	}
+	if err := usageRecorder.Close(shutdownCtx); err != nil {
+		slog.Error("Failed to flush usage", "error", err)
 	}
 }
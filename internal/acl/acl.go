@@ -0,0 +1,190 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+type rule struct {
+	prefix netip.Prefix
+	action string
+}
+
+type routeRules struct {
+	route string
+	rules []rule
+}
+
+// ACL keeps an in-memory copy of the acl_rules table. Deny rules always win;
+// a non-empty allowlist for a scope means only matching addresses get through.
+type ACL struct {
+	repo    store.ACLRepository
+	mux     sync.RWMutex
+	global  []rule
+	routes  []routeRules
+	clients map[string][]rule
+}
+
+func NewACL(repo store.ACLRepository) *ACL {
+	return &ACL{
+		repo:    repo,
+		clients: make(map[string][]rule),
+	}
+}
+
+// Start reloads the rules every interval until ctx is done, so changes made
+// through other replicas and rules removed along with their client take
+// effect.
+func (a *ACL) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := a.Load(ctx); err != nil {
+					slog.Error("Failed to reload acl", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("ACL reload started", "interval", interval)
+}
+
+func (a *ACL) Load(ctx context.Context) error {
+	rules, err := a.repo.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	var global []rule
+	routes := make(map[string][]rule)
+	clients := make(map[string][]rule)
+	for _, r := range rules {
+		prefix, err := ParseCIDR(r.CIDR)
+		if err != nil {
+			slog.Warn("Skipping invalid acl rule", "id", r.ID, "cidr", r.CIDR, "error", err)
+			continue
+		}
+		compiled := rule{prefix: prefix, action: r.Action}
+		switch {
+		case r.ClientID != "":
+			clients[r.ClientID] = append(clients[r.ClientID], compiled)
+		case r.Route != "":
+			routes[r.Route] = append(routes[r.Route], compiled)
+		default:
+			global = append(global, compiled)
+		}
+	}
+
+	routeList := make([]routeRules, 0, len(routes))
+	for route, rs := range routes {
+		routeList = append(routeList, routeRules{route: route, rules: rs})
+	}
+
+	a.mux.Lock()
+	a.global = global
+	a.routes = routeList
+	a.clients = clients
+	a.mux.Unlock()
+
+	slog.Debug("ACL loaded", "global", len(global), "routes", len(routeList), "clients", len(clients))
+	return nil
+}
+
+// Allowed evaluates the global rules and the rules of every route whose
+// prefix matches path.
+func (a *ACL) Allowed(addr netip.Addr, path string) bool {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	if !evaluate(a.global, addr) {
+		return false
+	}
+	for _, r := range a.routes {
+		if strings.HasPrefix(path, r.route) && !evaluate(r.rules, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientAllowed reports whether clientID may be used from addr. Clients
+// without an allowlist can be used from anywhere.
+func (a *ACL) ClientAllowed(addr netip.Addr, clientID string) bool {
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+
+	return evaluate(a.clients[clientID], addr)
+}
+
+func evaluate(rules []rule, addr netip.Addr) bool {
+	hasAllow, allowed := false, false
+	for _, r := range rules {
+		if r.action == ActionDeny {
+			if r.prefix.Contains(addr) {
+				return false
+			}
+			continue
+		}
+		hasAllow = true
+		if r.prefix.Contains(addr) {
+			allowed = true
+		}
+	}
+	return !hasAllow || allowed
+}
+
+// ParseCIDR accepts a network in CIDR notation or a bare address, which is
+// treated as a single-host network.
+func ParseCIDR(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ValidateRule checks a new rule and names the fields that are invalid.
+func ValidateRule(rule *models.CreateACLRule) []problem.InvalidParam {
+	var invalid []problem.InvalidParam
+	if rule.Action != ActionAllow && rule.Action != ActionDeny {
+		invalid = append(invalid, problem.Field("action", "must be %s or %s", ActionAllow, ActionDeny))
+	}
+	if _, err := ParseCIDR(rule.CIDR); err != nil {
+		invalid = append(invalid, problem.Field("cidr", "is invalid: %s", rule.CIDR))
+	}
+	if rule.ClientID != "" {
+		if rule.Action == ActionDeny {
+			invalid = append(invalid, problem.Field("action", "must be %s for client rules", ActionAllow))
+		}
+		if rule.Route != "" {
+			invalid = append(invalid, problem.Field("route", "must be empty for client rules"))
+		}
+	}
+	return invalid
+}
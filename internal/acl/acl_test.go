@@ -0,0 +1,157 @@
+package acl
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type fakeRepository struct {
+	store.ACLRepository
+	rules []*models.ACLRule
+}
+
+func (f *fakeRepository) GetAll(ctx context.Context) ([]*models.ACLRule, error) {
+	return f.rules, nil
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{in: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{in: "192.168.1.7", want: "192.168.1.7/32"},
+		{in: "::ffff:192.168.1.7", want: "192.168.1.7/32"},
+		{in: "2001:db8::1", want: "2001:db8::1/128"},
+		{in: "2001:db8::/32", want: "2001:db8::/32"},
+		{in: "10.0.0.0/33", wantErr: true},
+		{in: "not-an-address", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCIDR(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseCIDR(%q) = %s, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCIDR(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("ParseCIDR(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	allow := func(cidr string) rule { return rule{prefix: netip.MustParsePrefix(cidr), action: ActionAllow} }
+	deny := func(cidr string) rule { return rule{prefix: netip.MustParsePrefix(cidr), action: ActionDeny} }
+
+	tests := []struct {
+		name  string
+		rules []rule
+		addr  string
+		want  bool
+	}{
+		{name: "no rules", addr: "1.2.3.4", want: true},
+		{name: "denied", rules: []rule{deny("10.0.0.0/8")}, addr: "10.1.1.1", want: false},
+		{name: "outside deny", rules: []rule{deny("10.0.0.0/8")}, addr: "11.1.1.1", want: true},
+		{name: "allowed", rules: []rule{allow("10.0.0.0/8")}, addr: "10.1.1.1", want: true},
+		{name: "outside allowlist", rules: []rule{allow("10.0.0.0/8")}, addr: "11.1.1.1", want: false},
+		{name: "deny wins over allow", rules: []rule{allow("10.0.0.0/8"), deny("10.1.0.0/16")}, addr: "10.1.1.1", want: false},
+		{name: "deny wins in any order", rules: []rule{deny("10.1.0.0/16"), allow("10.0.0.0/8")}, addr: "10.1.1.1", want: false},
+		{name: "any allow matches", rules: []rule{allow("10.0.0.0/8"), allow("192.168.0.0/16")}, addr: "192.168.3.4", want: true},
+	}
+	for _, tt := range tests {
+		if got := evaluate(tt.rules, netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s: evaluate(%s) = %v, want %v", tt.name, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestACL(t *testing.T) {
+	repo := &fakeRepository{rules: []*models.ACLRule{
+		{ID: 1, Action: ActionDeny, CIDR: "10.0.0.0/8"},
+		{ID: 2, Action: ActionAllow, CIDR: "192.168.0.0/16", Route: "/admin"},
+		{ID: 3, Action: ActionAllow, CIDR: "172.16.0.0/12", ClientID: "user1"},
+		{ID: 4, Action: ActionDeny, CIDR: "garbage"},
+	}}
+	a := NewACL(repo)
+	if err := a.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	allowed := []struct {
+		addr string
+		path string
+		want bool
+	}{
+		{addr: "10.1.1.1", path: "/", want: false},
+		{addr: "8.8.8.8", path: "/", want: true},
+		{addr: "8.8.8.8", path: "/admin/users", want: false},
+		{addr: "192.168.1.1", path: "/admin/users", want: true},
+	}
+	for _, tt := range allowed {
+		if got := a.Allowed(netip.MustParseAddr(tt.addr), tt.path); got != tt.want {
+			t.Errorf("Allowed(%s, %s) = %v, want %v", tt.addr, tt.path, got, tt.want)
+		}
+	}
+
+	clients := []struct {
+		addr     string
+		clientID string
+		want     bool
+	}{
+		{addr: "172.16.5.5", clientID: "user1", want: true},
+		{addr: "8.8.8.8", clientID: "user1", want: false},
+		{addr: "8.8.8.8", clientID: "user2", want: true},
+	}
+	for _, tt := range clients {
+		if got := a.ClientAllowed(netip.MustParseAddr(tt.addr), tt.clientID); got != tt.want {
+			t.Errorf("ClientAllowed(%s, %s) = %v, want %v", tt.addr, tt.clientID, got, tt.want)
+		}
+	}
+
+	repo.rules = nil
+	if err := a.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !a.ClientAllowed(netip.MustParseAddr("8.8.8.8"), "user1") {
+		t.Error("ClientAllowed after reload kept a removed rule")
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    models.CreateACLRule
+		invalid []string
+	}{
+		{name: "valid", rule: models.CreateACLRule{Action: ActionDeny, CIDR: "10.0.0.0/8"}},
+		{name: "valid client rule", rule: models.CreateACLRule{Action: ActionAllow, CIDR: "10.0.0.1", ClientID: "user1"}},
+		{name: "bad action and cidr", rule: models.CreateACLRule{Action: "block", CIDR: "x"}, invalid: []string{"action", "cidr"}},
+		{name: "client deny", rule: models.CreateACLRule{Action: ActionDeny, CIDR: "10.0.0.1", ClientID: "user1"}, invalid: []string{"action"}},
+		{name: "client route", rule: models.CreateACLRule{Action: ActionAllow, CIDR: "10.0.0.1", ClientID: "user1", Route: "/x"}, invalid: []string{"route"}},
+	}
+	for _, tt := range tests {
+		invalid := ValidateRule(&tt.rule)
+		if len(invalid) != len(tt.invalid) {
+			t.Errorf("%s: ValidateRule = %v, want fields %v", tt.name, invalid, tt.invalid)
+			continue
+		}
+		for i, param := range invalid {
+			if param.Name != tt.invalid[i] {
+				t.Errorf("%s: invalid field %d = %s, want %s", tt.name, i, param.Name, tt.invalid[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package auth authenticates requests to the management API with admin
+// tokens and checks their roles.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+// Roles, each granting everything the ones before it do: viewer reads,
+// operator also changes clients and their tokens, admin also deletes clients
+// and manages plans, ACL rules and admin tokens.
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var levels = map[string]int{RoleViewer: 1, RoleOperator: 2, RoleAdmin: 3}
+
+// bootstrapName is the name the configured bootstrap token authenticates as.
+const bootstrapName = "bootstrap"
+
+func ValidRole(role string) bool {
+	_, ok := levels[role]
+	return ok
+}
+
+// Allows reports whether role grants what required does.
+func Allows(role, required string) bool {
+	return levels[role] >= levels[required]
+}
+
+// NewToken returns a random secret and the hash it is stored by.
+func NewToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("failed to generate admin token: %w", err)
+	}
+	secret := hex.EncodeToString(b)
+	return secret, Hash(secret), nil
+}
+
+// Hash is the hex SHA-256 of a secret. Secrets are random, so a fast hash is
+// enough to keep stolen hashes from being used as tokens.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type contextKey struct{}
+
+// FromContext returns the token a request was authenticated with, or nil.
+func FromContext(ctx context.Context) *models.AdminToken {
+	token, _ := ctx.Value(contextKey{}).(*models.AdminToken)
+	return token
+}
+
+// Authenticator checks the credentials of management API requests: a token
+// as "Authorization: Bearer <secret>", or basic auth with the token's name as
+// the user and its secret as the password.
+type Authenticator struct {
+	repo      store.AdminTokenRepository
+	bootstrap string
+}
+
+func NewAuthenticator(repo store.AdminTokenRepository, cfg config.AdminConfig) *Authenticator {
+	a := &Authenticator{repo: repo}
+	if cfg.BootstrapToken != "" {
+		a.bootstrap = Hash(cfg.BootstrapToken)
+		slog.Warn("Admin bootstrap token is enabled")
+	}
+	return a
+}
+
+// Require returns middleware that lets through requests authenticated with a
+// token of at least role. Others get 401, or 403 when the token's role is
+// too low.
+func (a *Authenticator) Require(role string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			token, err := a.authenticate(r)
+			if err != nil {
+				slog.Error("Failed to authenticate request", "path", r.URL.Path, "error", err)
+				problem.Write(w, r, http.StatusInternalServerError, "Failed to authenticate request")
+				return
+			}
+			if token == nil {
+				slog.Warn("Unauthenticated management request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+				w.Header().Add("WWW-Authenticate", `Bearer realm="admin"`)
+				w.Header().Add("WWW-Authenticate", `Basic realm="admin"`)
+				problem.Write(w, r, http.StatusUnauthorized, "Missing or invalid credentials")
+				return
+			}
+			if !Allows(token.Role, role) {
+				slog.Warn("Forbidden management request", "method", r.Method, "path", r.URL.Path, "token", token.Name, "role", token.Role)
+				problem.Write(w, r, http.StatusForbidden, fmt.Sprintf("Role %s is required, token %s has role %s", role, token.Name, token.Role))
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, token)))
+		}
+	}
+}
+
+// authenticate returns the token of the request's credentials, or nil when
+// there are none or they are wrong.
+func (a *Authenticator) authenticate(r *http.Request) (*models.AdminToken, error) {
+	var name, secret string
+	if user, password, ok := r.BasicAuth(); ok {
+		name, secret = user, password
+	} else if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		secret = strings.TrimSpace(header[7:])
+	}
+	if secret == "" {
+		return nil, nil
+	}
+
+	hash := Hash(secret)
+	if a.bootstrap != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(a.bootstrap)) == 1 {
+		if name != "" && name != bootstrapName {
+			return nil, nil
+		}
+		return &models.AdminToken{Name: bootstrapName, Role: RoleAdmin}, nil
+	}
+
+	token, err := a.repo.Authenticate(r.Context(), hash)
+	if err != nil || token == nil {
+		return nil, err
+	}
+	if name != "" && name != token.Name {
+		return nil, nil
+	}
+	return token, nil
+}
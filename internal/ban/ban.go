@@ -0,0 +1,176 @@
+package ban
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// Kinds of subjects that can be banned.
+const (
+	KindClient = "client"
+	KindIP     = "ip"
+)
+
+type subject struct {
+	kind  string
+	value string
+}
+
+// offender tracks the recent rejections of a subject and its ban history.
+type offender struct {
+	rejections []time.Time
+	offences   int
+	lastBan    time.Time
+	until      time.Time
+}
+
+// Jail bans clients and addresses that keep being rejected: after Threshold
+// rejections within Window a subject is banned for Duration, doubled (by
+// Multiplier) on every repeat offence up to MaxDuration. Offences are
+// forgotten once a subject has not been banned for ForgiveAfter. Everything is
+// kept in memory, so checking a ban costs no database round trip.
+type Jail struct {
+	cfg config.BanConfig
+
+	mux       sync.Mutex
+	offenders map[subject]*offender
+}
+
+func NewJail(cfg config.BanConfig) *Jail {
+	return &Jail{cfg: cfg, offenders: make(map[subject]*offender)}
+}
+
+// Start drops stale offenders periodically until ctx is done.
+func (j *Jail) Start(ctx context.Context) {
+	if j.cfg.Threshold <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				j.sweep(time.Now())
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("Bans enabled", "threshold", j.cfg.Threshold, "window", j.cfg.Window, "duration", j.cfg.Duration)
+}
+
+// Banned reports whether a subject is banned and until when.
+func (j *Jail) Banned(kind, value string) (time.Time, bool) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	o, ok := j.offenders[subject{kind: kind, value: value}]
+	if !ok || !time.Now().Before(o.until) {
+		return time.Time{}, false
+	}
+	return o.until, true
+}
+
+// Reject records a rejected request of a subject and bans it once it reaches
+// the threshold.
+func (j *Jail) Reject(kind, value string) {
+	if j.cfg.Threshold <= 0 || value == "" {
+		return
+	}
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	now := time.Now()
+	key := subject{kind: kind, value: value}
+	o, ok := j.offenders[key]
+	if !ok {
+		o = &offender{}
+		j.offenders[key] = o
+	}
+	if now.Before(o.until) {
+		return
+	}
+
+	cutoff := now.Add(-j.cfg.Window)
+	kept := o.rejections[:0]
+	for _, at := range o.rejections {
+		if at.After(cutoff) {
+			kept = append(kept, at)
+		}
+	}
+	o.rejections = append(kept, now)
+	if len(o.rejections) < j.cfg.Threshold {
+		return
+	}
+
+	if !o.lastBan.IsZero() && now.Sub(o.lastBan) > j.cfg.ForgiveAfter {
+		o.offences = 0
+	}
+	o.offences++
+	o.lastBan = now
+	o.until = now.Add(j.duration(o.offences))
+	o.rejections = nil
+	slog.Warn("Banned", "kind", kind, "subject", value, "offences", o.offences, "until", o.until)
+}
+
+// List returns the bans in force, ending soonest first.
+func (j *Jail) List() []*models.Ban {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	now := time.Now()
+	bans := []*models.Ban{}
+	for key, o := range j.offenders {
+		if now.Before(o.until) {
+			bans = append(bans, &models.Ban{Kind: key.kind, Subject: key.value, Until: o.until, Offences: o.offences})
+		}
+	}
+	sort.Slice(bans, func(a, b int) bool { return bans[a].Until.Before(bans[b].Until) })
+	return bans
+}
+
+// Lift ends a subject's ban early. Its offences still count towards the
+// length of the next one. It reports false if the subject was not banned.
+func (j *Jail) Lift(kind, value string) bool {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	o, ok := j.offenders[subject{kind: kind, value: value}]
+	if !ok || !time.Now().Before(o.until) {
+		return false
+	}
+	o.until = time.Time{}
+	o.rejections = nil
+	slog.Info("Ban lifted", "kind", kind, "subject", value)
+	return true
+}
+
+func (j *Jail) duration(offences int) time.Duration {
+	d := j.cfg.Duration
+	for i := 1; i < offences && d < j.cfg.MaxDuration; i++ {
+		d = time.Duration(float64(d) * j.cfg.Multiplier)
+	}
+	return min(d, j.cfg.MaxDuration)
+}
+
+// sweep forgets subjects that are neither banned, nor recently rejected, nor
+// still within the time their offences are remembered.
+func (j *Jail) sweep(now time.Time) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	for key, o := range j.offenders {
+		recent := len(o.rejections) > 0 && o.rejections[len(o.rejections)-1].After(now.Add(-j.cfg.Window))
+		remembered := !o.lastBan.IsZero() && now.Sub(o.lastBan) <= j.cfg.ForgiveAfter
+		if !now.Before(o.until) && !recent && !remembered {
+			delete(j.offenders, key)
+		}
+	}
+}
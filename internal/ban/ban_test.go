@@ -0,0 +1,149 @@
+package ban
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dorik33/cloud/internal/config"
+)
+
+func testConfig() config.BanConfig {
+	return config.BanConfig{
+		Threshold:    3,
+		Window:       time.Hour,
+		Duration:     time.Minute,
+		Multiplier:   2,
+		MaxDuration:  5 * time.Minute,
+		ForgiveAfter: time.Hour,
+	}
+}
+
+func TestRejectThreshold(t *testing.T) {
+	j := NewJail(testConfig())
+
+	for i := 1; i < 3; i++ {
+		j.Reject(KindClient, "user1")
+		if _, banned := j.Banned(KindClient, "user1"); banned {
+			t.Fatalf("banned after %d rejections, want after 3", i)
+		}
+	}
+	j.Reject(KindClient, "user1")
+	until, banned := j.Banned(KindClient, "user1")
+	if !banned {
+		t.Fatal("not banned after 3 rejections")
+	}
+	if d := time.Until(until); d <= 0 || d > time.Minute {
+		t.Errorf("ban lasts %s, want up to 1m", d)
+	}
+
+	if _, banned := j.Banned(KindIP, "user1"); banned {
+		t.Error("ban of a client applied to an address with the same value")
+	}
+	if _, banned := j.Banned(KindClient, "user2"); banned {
+		t.Error("ban applied to another client")
+	}
+}
+
+func TestRejectWindow(t *testing.T) {
+	cfg := testConfig()
+	cfg.Window = 20 * time.Millisecond
+	j := NewJail(cfg)
+
+	j.Reject(KindIP, "10.0.0.1")
+	j.Reject(KindIP, "10.0.0.1")
+	time.Sleep(30 * time.Millisecond)
+	j.Reject(KindIP, "10.0.0.1")
+	if _, banned := j.Banned(KindIP, "10.0.0.1"); banned {
+		t.Error("banned for rejections spread over more than the window")
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	cfg := testConfig()
+	cfg.Duration = 20 * time.Millisecond
+	j := NewJail(cfg)
+
+	for range 3 {
+		j.Reject(KindClient, "user1")
+	}
+	if _, banned := j.Banned(KindClient, "user1"); !banned {
+		t.Fatal("not banned after 3 rejections")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, banned := j.Banned(KindClient, "user1"); banned {
+		t.Error("still banned after the ban expired")
+	}
+	if bans := j.List(); len(bans) != 0 {
+		t.Errorf("List = %d bans, want none", len(bans))
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	cfg := testConfig()
+	cfg.Threshold = 0
+	j := NewJail(cfg)
+
+	for range 10 {
+		j.Reject(KindClient, "user1")
+	}
+	if _, banned := j.Banned(KindClient, "user1"); banned {
+		t.Error("banned with bans disabled")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	j := NewJail(testConfig())
+	tests := []struct {
+		offences int
+		want     time.Duration
+	}{
+		{offences: 1, want: time.Minute},
+		{offences: 2, want: 2 * time.Minute},
+		{offences: 3, want: 4 * time.Minute},
+		{offences: 4, want: 5 * time.Minute},
+		{offences: 10, want: 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := j.duration(tt.offences); got != tt.want {
+			t.Errorf("duration(%d) = %s, want %s", tt.offences, got, tt.want)
+		}
+	}
+}
+
+func TestLift(t *testing.T) {
+	j := NewJail(testConfig())
+	for range 3 {
+		j.Reject(KindClient, "user1")
+	}
+	if !j.Lift(KindClient, "user1") {
+		t.Fatal("Lift = false for a banned client")
+	}
+	if _, banned := j.Banned(KindClient, "user1"); banned {
+		t.Error("still banned after Lift")
+	}
+	if j.Lift(KindClient, "user1") {
+		t.Error("Lift = true for a client that is no longer banned")
+	}
+
+	// The lifted ban still counts as an offence.
+	for range 3 {
+		j.Reject(KindClient, "user1")
+	}
+	until, banned := j.Banned(KindClient, "user1")
+	if !banned || time.Until(until) <= time.Minute {
+		t.Errorf("second ban until %s, want longer than 1m", until)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	j := NewJail(testConfig())
+	j.Reject(KindClient, "user1")
+	for range 3 {
+		j.Reject(KindClient, "user2")
+	}
+
+	j.sweep(time.Now().Add(2 * time.Hour))
+	if len(j.offenders) != 0 {
+		t.Errorf("%d offenders left after sweep, want none", len(j.offenders))
+	}
+}
@@ -3,20 +3,109 @@ package config
 import (
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type Config struct {
-	Port      string          `yaml:"port"`
-	Backends  []string        `yaml:"backends"`
-	RateLimit RateLimitConfig `yaml:"rate_limit"`
-	DBConnStr string          `yaml:"db_conn_str"`
+	Port        string            `yaml:"port"`
+	Backends    []string          `yaml:"backends"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Ceilings    CeilingsConfig    `yaml:"ceilings"`
+	Bans        BanConfig         `yaml:"bans"`
+	ACL         ACLConfig         `yaml:"acl"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	Admin       AdminConfig       `yaml:"admin"`
+	DBConnStr   string            `yaml:"db_conn_str"`
 }
 
+const (
+	RateLimitModePostgres = "postgres"
+	RateLimitModeMemory   = "memory"
+	RateLimitModeLease    = "lease"
+)
+
 type RateLimitConfig struct {
-	Capacity int `yaml:"default_capacity"`
-	Rate     int `yaml:"default_rate"`
+	Capacity      int           `yaml:"default_capacity"`
+	Rate          int           `yaml:"default_rate"`
+	Algorithm     string        `yaml:"default_algorithm" env-default:"token_bucket"`
+	WindowSeconds int           `yaml:"default_window_seconds" env-default:"60"`
+	Mode          string        `yaml:"mode" env-default:"postgres"`
+	FlushInterval time.Duration `yaml:"flush_interval" env-default:"5s"`
+	LeaseSize     int           `yaml:"lease_size" env-default:"50"`
+	LeaseTTL      time.Duration `yaml:"lease_ttl" env-default:"1s"`
+	DefaultCost   int           `yaml:"default_cost" env-default:"10"`
+	CostHeader    string        `yaml:"cost_header"`
+	CostRules     []CostRule    `yaml:"cost_rules"`
+	Shadow        bool          `yaml:"shadow"`
+	MaxDelay      time.Duration `yaml:"default_max_delay" env-default:"5s"`
+	MaxQueued     int           `yaml:"default_max_queued" env-default:"100"`
+}
+
+// CostRule sets the token cost of requests it matches. Empty fields match
+// anything; Route is a path prefix and Path a path.Match pattern.
+type CostRule struct {
+	Method string `yaml:"method"`
+	Route  string `yaml:"route"`
+	Path   string `yaml:"path"`
+	Header string `yaml:"header"`
+	Value  string `yaml:"value"`
+	Cost   int    `yaml:"cost"`
+}
+
+// CeilingsConfig limits traffic independently of clients: Global applies to
+// every request the listener accepts, Backend to each backend unless Backends
+// has an entry for its URL.
+type CeilingsConfig struct {
+	Global   CeilingConfig            `yaml:"global"`
+	Backend  CeilingConfig            `yaml:"backend"`
+	Backends map[string]CeilingConfig `yaml:"backends"`
+}
+
+// CeilingConfig is a requests per second limit with bursts of Burst requests.
+// A zero RPS disables the limit.
+type CeilingConfig struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+// BackendCeiling returns the ceiling configured for the backend at url.
+func (c CeilingsConfig) BackendCeiling(url string) CeilingConfig {
+	if ceiling, ok := c.Backends[url]; ok {
+		return ceiling
+	}
+	return c.Backend
+}
+
+// BanConfig sets when clients and addresses that keep hitting their limits
+// are banned. A zero Threshold disables bans.
+type BanConfig struct {
+	Threshold    int           `yaml:"threshold"`
+	Window       time.Duration `yaml:"window" env-default:"10s"`
+	Duration     time.Duration `yaml:"duration" env-default:"1m"`
+	Multiplier   float64       `yaml:"multiplier" env-default:"2"`
+	MaxDuration  time.Duration `yaml:"max_duration" env-default:"1h"`
+	ForgiveAfter time.Duration `yaml:"forgive_after" env-default:"24h"`
+}
+
+// ACLConfig sets how often the acl rules are reloaded from the database.
+type ACLConfig struct {
+	ReloadInterval time.Duration `yaml:"reload_interval" env-default:"30s"`
+}
+
+// IdempotencyConfig sets how long responses to requests with an
+// Idempotency-Key are kept for replay.
+type IdempotencyConfig struct {
+	Retention time.Duration `yaml:"retention" env-default:"24h"`
+}
+
+// AdminConfig sets the listener of the management API. BootstrapToken, when
+// set, authenticates as an admin without being stored, so the first tokens
+// can be created and access regained should they all be lost.
+type AdminConfig struct {
+	Port           string `yaml:"port" env-default:"8086"`
+	BootstrapToken string `yaml:"bootstrap_token" env:"ADMIN_BOOTSTRAP_TOKEN"`
 }
 
 func LoadConfig(path string) *Config {
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/dorik33/cloud/internal/acl"
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type ACLHandler struct {
+	repo store.ACLRepository
+	acl  *acl.ACL
+}
+
+func NewACLHandler(repo store.ACLRepository, acl *acl.ACL) *ACLHandler {
+	return &ACLHandler{repo: repo, acl: acl}
+}
+
+func (h *ACLHandler) GetRulesHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling get acl rules request", "method", r.Method, "path", r.URL.Path)
+
+	rules, err := h.repo.GetAll(r.Context())
+	if err != nil {
+		slog.Error("Failed to get acl rules", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Error with server")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(rules)
+}
+
+func (h *ACLHandler) CreateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling create acl rule request", "method", r.Method, "path", r.URL.Path)
+
+	req := models.CreateACLRule{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if invalid := acl.ValidateRule(&req); len(invalid) > 0 {
+		slog.Error("Invalid acl rule", "invalid", len(invalid))
+		problem.Invalid(w, r, invalid...)
+		return
+	}
+	prefix, _ := acl.ParseCIDR(req.CIDR)
+
+	rule := &models.ACLRule{
+		Action:   req.Action,
+		CIDR:     prefix.String(),
+		Route:    req.Route,
+		ClientID: req.ClientID,
+	}
+	err := h.repo.Create(r.Context(), rule)
+	if errors.Is(err, store.ErrUnknownReference) {
+		problem.Write(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("Client %s not found", req.ClientID),
+			problem.Field("client_id", "refers to unknown client %s", req.ClientID))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create acl rule", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to create acl rule")
+		return
+	}
+	h.reload(r)
+
+	slog.Info("ACL rule created", "id", rule.ID, "action", rule.Action, "cidr", rule.CIDR, "route", rule.Route, "client_id", rule.ClientID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+func (h *ACLHandler) DeleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, "Invalid rule id")
+		return
+	}
+	slog.Debug("Deleting acl rule", "id", id)
+
+	deleted, err := h.repo.Delete(r.Context(), id)
+	if err != nil {
+		slog.Error("Failed to delete acl rule", "id", id, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to delete acl rule")
+		return
+	}
+	if !deleted {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("ACL rule with id %d not found", id))
+		return
+	}
+	h.reload(r)
+
+	slog.Info("ACL rule deleted", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *ACLHandler) reload(r *http.Request) {
+	if err := h.acl.Load(r.Context()); err != nil {
+		slog.Error("Failed to reload acl", "error", err)
+	}
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/dorik33/cloud/internal/auth"
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type AdminTokenHandler struct {
+	repo store.AdminTokenRepository
+}
+
+func NewAdminTokenHandler(repo store.AdminTokenRepository) *AdminTokenHandler {
+	return &AdminTokenHandler{repo: repo}
+}
+
+func (h *AdminTokenHandler) GetTokensHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling get admin tokens request", "method", r.Method, "path", r.URL.Path)
+
+	tokens, err := h.repo.GetAll(r.Context())
+	if err != nil {
+		slog.Error("Failed to get admin tokens", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Error with server")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (h *AdminTokenHandler) GetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	slog.Debug("Getting admin token", "id", id)
+
+	token, err := h.repo.GetByID(r.Context(), id)
+	if err != nil {
+		slog.Error("Failed to get admin token", "id", id, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get admin token")
+		return
+	}
+	if token == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Admin token with id %d not found", id))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+// CreateTokenHandler creates a token and returns its secret. The secret is
+// not stored and cannot be read again.
+func (h *AdminTokenHandler) CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling create admin token request", "method", r.Method, "path", r.URL.Path)
+
+	req := models.CreateAdminToken{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if invalid := validateAdminToken(req.Name, req.Role); len(invalid) > 0 {
+		problem.Invalid(w, r, invalid...)
+		return
+	}
+
+	secret, hash, err := auth.NewToken()
+	if err != nil {
+		slog.Error("Failed to generate admin token", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to create admin token")
+		return
+	}
+	token := &models.AdminToken{Name: req.Name, Role: req.Role}
+	err = h.repo.Create(r.Context(), token, hash)
+	if errors.Is(err, store.ErrAdminTokenExists) {
+		problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Admin token %s already exists", req.Name))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create admin token", "name", req.Name, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to create admin token")
+		return
+	}
+	token.Token = secret
+
+	slog.Info("Admin token created", "id", token.ID, "name", token.Name, "role", token.Role, "by", actor(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func (h *AdminTokenHandler) UpdateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	slog.Debug("Updating admin token", "id", id)
+
+	req := models.UpdateAdminToken{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "id", id, "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if invalid := validateAdminToken(req.Name, req.Role); len(invalid) > 0 {
+		problem.Invalid(w, r, invalid...)
+		return
+	}
+
+	token := &models.AdminToken{ID: id, Name: req.Name, Role: req.Role}
+	updated, err := h.repo.Update(r.Context(), token)
+	if errors.Is(err, store.ErrAdminTokenExists) {
+		problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Admin token %s already exists", req.Name))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update admin token", "id", id, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to update admin token")
+		return
+	}
+	if !updated {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Admin token with id %d not found", id))
+		return
+	}
+
+	slog.Info("Admin token updated", "id", id, "name", token.Name, "role", token.Role, "by", actor(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(token)
+}
+
+func (h *AdminTokenHandler) DeleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := tokenID(w, r)
+	if !ok {
+		return
+	}
+	slog.Debug("Deleting admin token", "id", id)
+
+	deleted, err := h.repo.Delete(r.Context(), id)
+	if err != nil {
+		slog.Error("Failed to delete admin token", "id", id, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to delete admin token")
+		return
+	}
+	if !deleted {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Admin token with id %d not found", id))
+		return
+	}
+
+	slog.Info("Admin token deleted", "id", id, "by", actor(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tokenID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, "Invalid token id")
+		return 0, false
+	}
+	return id, true
+}
+
+func validateAdminToken(name, role string) []problem.InvalidParam {
+	var invalid []problem.InvalidParam
+	if name == "" {
+		invalid = append(invalid, problem.Field("name", "is required"))
+	}
+	if !auth.ValidRole(role) {
+		invalid = append(invalid, problem.Field("role", "must be viewer, operator or admin"))
+	}
+	return invalid
+}
+
+// actor names the token a management request was authenticated with.
+func actor(r *http.Request) string {
+	if token := auth.FromContext(r.Context()); token != nil {
+		return token.Name
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/dorik33/cloud/internal/ban"
+	"github.com/dorik33/cloud/internal/problem"
+)
+
+type BanHandler struct {
+	jail *ban.Jail
+}
+
+func NewBanHandler(jail *ban.Jail) *BanHandler {
+	return &BanHandler{jail: jail}
+}
+
+func (h *BanHandler) GetBansHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling get bans request", "method", r.Method, "path", r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.jail.List())
+}
+
+func (h *BanHandler) LiftBanHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.PathValue("kind")
+	subject := r.PathValue("subject")
+	slog.Debug("Lifting ban", "kind", kind, "subject", subject)
+
+	if kind != ban.KindClient && kind != ban.KindIP {
+		problem.Invalid(w, r, problem.Field("kind", "must be client or ip"))
+		return
+	}
+	if !h.jail.Lift(kind, subject) {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("No ban on %s %s", kind, subject))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
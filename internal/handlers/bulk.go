@@ -0,0 +1,474 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+const (
+	maxBulkBodySize = 10 << 20
+	maxBulkRows     = 10000
+)
+
+// Statuses of the rows of a bulk import besides the store outcomes.
+const (
+	bulkInvalid    = "invalid"
+	bulkConflict   = "conflict"
+	bulkFailed     = "failed"
+	bulkNotApplied = "not_applied"
+)
+
+// bulkColumn maps a CSV column to a field of models.CreateClient.
+type bulkColumn struct {
+	name string
+	get  func(c *models.CreateClient) string
+	set  func(c *models.CreateClient, value string) error
+}
+
+func stringColumn(name string, field func(c *models.CreateClient) *string) bulkColumn {
+	return bulkColumn{
+		name: name,
+		get:  func(c *models.CreateClient) string { return *field(c) },
+		set: func(c *models.CreateClient, value string) error {
+			*field(c) = value
+			return nil
+		},
+	}
+}
+
+func intColumn(name string, field func(c *models.CreateClient) *int) bulkColumn {
+	return bulkColumn{
+		name: name,
+		get:  func(c *models.CreateClient) string { return strconv.Itoa(*field(c)) },
+		set: func(c *models.CreateClient, value string) error {
+			if value == "" {
+				return nil
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return problem.Field(name, "must be an integer")
+			}
+			*field(c) = n
+			return nil
+		},
+	}
+}
+
+// bulkColumns are the CSV columns of import and export, in export order.
+var bulkColumns = []bulkColumn{
+	stringColumn("client_id", func(c *models.CreateClient) *string { return &c.ClientID }),
+	stringColumn("parent_id", func(c *models.CreateClient) *string { return &c.ParentID }),
+	stringColumn("plan_id", func(c *models.CreateClient) *string { return &c.PlanID }),
+	intColumn(models.FieldCapacity, func(c *models.CreateClient) *int { return &c.Capacity }),
+	intColumn(models.FieldRatePerSec, func(c *models.CreateClient) *int { return &c.RatePerSec }),
+	stringColumn(models.FieldAlgorithm, func(c *models.CreateClient) *string { return &c.Algorithm }),
+	intColumn(models.FieldWindowSeconds, func(c *models.CreateClient) *int { return &c.WindowSeconds }),
+	{
+		name: "shadow",
+		get:  func(c *models.CreateClient) string { return strconv.FormatBool(c.Shadow) },
+		set: func(c *models.CreateClient, value string) error {
+			if value == "" {
+				return nil
+			}
+			shadow, err := strconv.ParseBool(value)
+			if err != nil {
+				return problem.Field("shadow", "must be true or false")
+			}
+			c.Shadow = shadow
+			return nil
+		},
+	},
+	stringColumn("on_limit", func(c *models.CreateClient) *string { return &c.OnLimit }),
+	intColumn("max_delay_ms", func(c *models.CreateClient) *int { return &c.MaxDelayMs }),
+	intColumn("max_queued", func(c *models.CreateClient) *int { return &c.MaxQueued }),
+	intColumn("request_bytes_per_sec", func(c *models.CreateClient) *int { return &c.RequestBytesPerSec }),
+	intColumn("response_bytes_per_sec", func(c *models.CreateClient) *int { return &c.ResponseBytesPerSec }),
+}
+
+// bulkRow is a row of an import and what became of it. Line is the line of
+// the row in the request body.
+type bulkRow struct {
+	Line          int                    `json:"line"`
+	ClientID      string                 `json:"client_id,omitempty"`
+	Status        string                 `json:"status"`
+	Error         string                 `json:"error,omitempty"`
+	InvalidParams []problem.InvalidParam `json:"invalid_params,omitempty"`
+
+	req models.CreateClient
+}
+
+type bulkReport struct {
+	Mode    string     `json:"mode"`
+	Applied bool       `json:"applied"`
+	Created int        `json:"created"`
+	Updated int        `json:"updated"`
+	Skipped int        `json:"skipped"`
+	Failed  int        `json:"failed"`
+	Rows    []*bulkRow `json:"rows"`
+}
+
+// BulkImportHandler creates or updates the clients listed in an NDJSON or CSV
+// body in one transaction. The mode query parameter says what to do with
+// clients that already exist: fail (the default), skip or upsert. Nothing is
+// written unless every row can be; the report lists the outcome of each row.
+func (h *ClientHandler) BulkImportHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling bulk import request", "method", r.Method, "path", r.URL.Path)
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = store.ImportFail
+	case store.ImportFail, store.ImportSkip, store.ImportUpsert:
+	default:
+		problem.Invalid(w, r, problem.Field("mode", "must be fail, skip or upsert"))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxBulkBodySize)
+	var rows []*bulkRow
+	var err error
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "application/x-ndjson", "application/jsonl":
+		rows, err = readNDJSONRows(body)
+	case "text/csv":
+		rows, err = readCSVRows(body)
+	default:
+		problem.Write(w, r, http.StatusUnsupportedMediaType, "Content type must be application/x-ndjson or text/csv")
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		problem.Write(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Body must be at most %d bytes", tooLarge.Limit))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to read bulk import", "error", err)
+		problem.BadRequest(w, r, err)
+		return
+	}
+	if len(rows) == 0 {
+		problem.Write(w, r, http.StatusBadRequest, "No clients to import")
+		return
+	}
+
+	report := &bulkReport{Mode: mode, Rows: rows}
+	clients, ok := h.bulkClients(w, r, rows)
+	if !ok {
+		return
+	}
+	if clients == nil {
+		report.finish(nil)
+		slog.Info("Bulk import rejected", "rows", len(rows), "failed", report.Failed)
+		writeBulkReport(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	outcomes, err := h.repo.Import(r.Context(), clients, mode)
+	var importErr *store.ImportError
+	if errors.As(err, &importErr) {
+		row := rows[importErr.Index]
+		row.Status = bulkFailed
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, store.ErrClientExists) {
+			row.Status = bulkConflict
+			status = http.StatusConflict
+		}
+		row.Error = importErr.Err.Error()
+		if importErr.Field != "" {
+			row.InvalidParams = []problem.InvalidParam{problem.Field(importErr.Field, "%v", importErr.Err)}
+		}
+		report.finish(nil)
+		slog.Info("Bulk import rejected", "rows", len(rows), "line", row.Line, "error", importErr.Err)
+		writeBulkReport(w, status, report)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to import clients", "rows", len(rows), "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to import clients")
+		return
+	}
+
+	for i, client := range clients {
+		if outcomes[i] != store.ImportSkipped {
+			h.rl.SetClient(client)
+		}
+	}
+	report.finish(outcomes)
+	slog.Info("Clients imported", "mode", mode, "created", report.Created, "updated", report.Updated, "skipped", report.Skipped)
+	writeBulkReport(w, http.StatusOK, report)
+}
+
+// bulkClients validates the rows and builds their clients. It marks the
+// invalid rows and returns nil if there are any. It writes the error response
+// and returns false when the plans cannot be loaded.
+func (h *ClientHandler) bulkClients(w http.ResponseWriter, r *http.Request, rows []*bulkRow) ([]*models.Client, bool) {
+	plans := map[string]*models.Plan{}
+	seen := map[string]bool{}
+	clients := make([]*models.Client, 0, len(rows))
+	valid := true
+	for _, row := range rows {
+		if row.Status == bulkInvalid {
+			valid = false
+			continue
+		}
+		req := &row.req
+		row.ClientID = req.ClientID
+
+		invalid := validateClient(req.Algorithm, req.OnLimit, req.RequestBytesPerSec, req.ResponseBytesPerSec)
+		switch {
+		case req.ClientID == "":
+			invalid = append(invalid, problem.Field("client_id", "is required"))
+		case seen[req.ClientID]:
+			invalid = append(invalid, problem.Field("client_id", "is repeated"))
+		}
+		seen[req.ClientID] = true
+		if req.ParentID != "" && req.ParentID == req.ClientID {
+			invalid = append(invalid, problem.Field("parent_id", "would make client %s its own ancestor", req.ClientID))
+		}
+
+		var plan *models.Plan
+		if req.PlanID != "" {
+			var ok bool
+			if plan, ok = plans[req.PlanID]; !ok {
+				var err error
+				if plan, err = h.plans.GetByID(r.Context(), req.PlanID); err != nil {
+					slog.Error("Failed to get plan", "plan_id", req.PlanID, "error", err)
+					problem.Write(w, r, http.StatusInternalServerError, "Failed to get plan")
+					return nil, false
+				}
+				plans[req.PlanID] = plan
+			}
+			if plan == nil {
+				invalid = append(invalid, problem.Field("plan_id", "refers to unknown plan %s", req.PlanID))
+			}
+		}
+
+		if len(invalid) > 0 {
+			row.Status = bulkInvalid
+			row.InvalidParams = invalid
+			valid = false
+			continue
+		}
+		clients = append(clients, h.newClient(req, plan))
+	}
+	if !valid {
+		return nil, true
+	}
+	return clients, true
+}
+
+// finish fills in the statuses of the rows and the totals. Without outcomes
+// the import was not applied.
+func (b *bulkReport) finish(outcomes []string) {
+	b.Applied = outcomes != nil
+	for i, row := range b.Rows {
+		switch {
+		case outcomes != nil:
+			row.Status = outcomes[i]
+		case row.Status == "":
+			row.Status = bulkNotApplied
+		}
+		switch row.Status {
+		case store.ImportCreated:
+			b.Created++
+		case store.ImportUpdated:
+			b.Updated++
+		case store.ImportSkipped:
+			b.Skipped++
+		case bulkInvalid, bulkConflict, bulkFailed:
+			b.Failed++
+		}
+	}
+}
+
+func writeBulkReport(w http.ResponseWriter, status int, report *bulkReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// readNDJSONRows reads one client per line, skipping blank lines. A line that
+// is not a client object makes an invalid row.
+func readNDJSONRows(body io.Reader) ([]*bulkRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var rows []*bulkRow
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if len(rows) == maxBulkRows {
+			return nil, fmt.Errorf("at most %d clients can be imported at once", maxBulkRows)
+		}
+		row := &bulkRow{Line: line}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&row.req); err != nil {
+			row.Status = bulkInvalid
+			row.Error = fmt.Sprintf("invalid client: %v", err)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	return rows, nil
+}
+
+// readCSVRows reads a header naming some of bulkColumns and then one client
+// per record. Empty cells leave their fields unset.
+func readCSVRows(body io.Reader) ([]*bulkRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+	columns := make([]bulkColumn, len(header))
+	for i, name := range header {
+		j := slices.IndexFunc(bulkColumns, func(c bulkColumn) bool { return c.name == name })
+		if j < 0 {
+			return nil, problem.Field("header", "has unknown column %s", name)
+		}
+		columns[i] = bulkColumns[j]
+	}
+
+	var rows []*bulkRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv: %w", err)
+		}
+		if len(rows) == maxBulkRows {
+			return nil, fmt.Errorf("at most %d clients can be imported at once", maxBulkRows)
+		}
+		line, _ := reader.FieldPos(0)
+		row := &bulkRow{Line: line}
+		if len(record) != len(columns) {
+			row.Status = bulkInvalid
+			row.Error = fmt.Sprintf("row has %d fields, header has %d", len(record), len(columns))
+		}
+		for i := 0; i < len(record) && i < len(columns); i++ {
+			if err := columns[i].set(&row.req, record[i]); err != nil {
+				var invalid problem.InvalidParam
+				errors.As(err, &invalid)
+				row.Status = bulkInvalid
+				row.InvalidParams = append(row.InvalidParams, invalid)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ExportClientsHandler streams every client as NDJSON or, with format=csv, as
+// CSV, in the form BulkImportHandler accepts. Limits a client takes from its
+// plan are left out, so that an import keeps them following the plan.
+func (h *ClientHandler) ExportClientsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling export clients request", "method", r.Method, "path", r.URL.Path)
+
+	var write func(row *models.CreateClient) error
+	var flush func() error
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="clients.ndjson"`)
+		encoder := json.NewEncoder(w)
+		write = func(row *models.CreateClient) error { return encoder.Encode(row) }
+		flush = func() error { return nil }
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="clients.csv"`)
+		cw := csv.NewWriter(w)
+		header := make([]string, len(bulkColumns))
+		for i, column := range bulkColumns {
+			header[i] = column.name
+		}
+		cw.Write(header)
+		write = func(row *models.CreateClient) error {
+			record := make([]string, len(bulkColumns))
+			for i, column := range bulkColumns {
+				record[i] = column.get(row)
+			}
+			return cw.Write(record)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		problem.Invalid(w, r, problem.Field("format", "must be ndjson or csv"))
+		return
+	}
+
+	count := 0
+	err := h.repo.Export(r.Context(), func(client *models.Client) error {
+		count++
+		return write(exportRow(client))
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		// The status is sent with the first row, so a failure can only cut
+		// the export short.
+		slog.Error("Failed to export clients", "exported", count, "error", err)
+		return
+	}
+	slog.Info("Clients exported", "count", count)
+}
+
+// exportRow converts a client into an import row.
+func exportRow(client *models.Client) *models.CreateClient {
+	row := &models.CreateClient{
+		ClientID:            client.ClientID,
+		ParentID:            client.ParentID,
+		PlanID:              client.PlanID,
+		Capacity:            client.Capacity,
+		RatePerSec:          client.RatePerSec,
+		Algorithm:           client.Algorithm,
+		WindowSeconds:       client.WindowSeconds,
+		Shadow:              client.Shadow,
+		OnLimit:             client.OnLimit,
+		MaxDelayMs:          client.MaxDelayMs,
+		MaxQueued:           client.MaxQueued,
+		RequestBytesPerSec:  client.RequestBytesPerSec,
+		ResponseBytesPerSec: client.ResponseBytesPerSec,
+	}
+	if client.PlanID != "" {
+		if !slices.Contains(client.Overrides, models.FieldCapacity) {
+			row.Capacity = 0
+		}
+		if !slices.Contains(client.Overrides, models.FieldRatePerSec) {
+			row.RatePerSec = 0
+		}
+		if !slices.Contains(client.Overrides, models.FieldAlgorithm) {
+			row.Algorithm = ""
+		}
+		if !slices.Contains(client.Overrides, models.FieldWindowSeconds) {
+			row.WindowSeconds = 0
+		}
+	}
+	return row
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+func TestReadNDJSONRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []models.CreateClient
+		lines   []int
+		invalid []bool
+	}{
+		{
+			name:    "one client per line",
+			body:    `{"client_id": "a", "capacity": 10}` + "\n" + `{"client_id": "b", "plan_id": "basic"}` + "\n",
+			want:    []models.CreateClient{{ClientID: "a", Capacity: 10}, {ClientID: "b", PlanID: "basic"}},
+			lines:   []int{1, 2},
+			invalid: []bool{false, false},
+		},
+		{
+			name:    "blank lines are skipped but counted",
+			body:    "\n" + `{"client_id": "a"}` + "\n   \n" + `{"client_id": "b"}`,
+			want:    []models.CreateClient{{ClientID: "a"}, {ClientID: "b"}},
+			lines:   []int{2, 4},
+			invalid: []bool{false, false},
+		},
+		{
+			name:    "malformed line",
+			body:    `{"client_id": "a"}` + "\n" + `{"client_id": ` + "\n",
+			want:    []models.CreateClient{{ClientID: "a"}, {}},
+			lines:   []int{1, 2},
+			invalid: []bool{false, true},
+		},
+		{
+			name:    "unknown field",
+			body:    `{"client_id": "a", "colour": "red"}`,
+			want:    []models.CreateClient{{ClientID: "a"}},
+			lines:   []int{1},
+			invalid: []bool{true},
+		},
+		{
+			name: "empty body",
+			body: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readNDJSONRows(strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("readNDJSONRows() error = %v", err)
+			}
+			checkRows(t, rows, tt.want, tt.lines, tt.invalid)
+		})
+	}
+}
+
+func TestReadCSVRows(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []models.CreateClient
+		lines   []int
+		invalid []bool
+		wantErr bool
+	}{
+		{
+			name:    "columns in any order",
+			body:    "capacity,client_id,shadow\n10,a,true\n,b,\n",
+			want:    []models.CreateClient{{ClientID: "a", Capacity: 10, Shadow: true}, {ClientID: "b"}},
+			lines:   []int{2, 3},
+			invalid: []bool{false, false},
+		},
+		{
+			name:    "quoted cell spanning lines",
+			body:    "client_id,plan_id\n\"a\nb\",basic\nc,\n",
+			want:    []models.CreateClient{{ClientID: "a\nb", PlanID: "basic"}, {ClientID: "c"}},
+			lines:   []int{2, 4},
+			invalid: []bool{false, false},
+		},
+		{
+			name:    "not an integer",
+			body:    "client_id,capacity\na,ten\n",
+			want:    []models.CreateClient{{ClientID: "a"}},
+			lines:   []int{2},
+			invalid: []bool{true},
+		},
+		{
+			name:    "not a boolean",
+			body:    "client_id,shadow\na,maybe\n",
+			want:    []models.CreateClient{{ClientID: "a"}},
+			lines:   []int{2},
+			invalid: []bool{true},
+		},
+		{
+			name:    "wrong number of fields",
+			body:    "client_id,capacity\na\nb,5,6\n",
+			want:    []models.CreateClient{{ClientID: "a"}, {ClientID: "b", Capacity: 5}},
+			lines:   []int{2, 3},
+			invalid: []bool{true, true},
+		},
+		{
+			name:    "unknown column",
+			body:    "client_id,colour\na,red\n",
+			wantErr: true,
+		},
+		{
+			name: "empty body",
+			body: "",
+		},
+		{
+			name: "header only",
+			body: "client_id,capacity\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readCSVRows(strings.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCSVRows() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			checkRows(t, rows, tt.want, tt.lines, tt.invalid)
+		})
+	}
+}
+
+func TestExportRow(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *models.Client
+		want   models.CreateClient
+	}{
+		{
+			name:   "standalone client keeps its limits",
+			client: &models.Client{ClientID: "a", ParentID: "p", Capacity: 10, RatePerSec: 2, Algorithm: "sliding_window", WindowSeconds: 30, OnLimit: "delay", MaxDelayMs: 500, MaxQueued: 3},
+			want:   models.CreateClient{ClientID: "a", ParentID: "p", Capacity: 10, RatePerSec: 2, Algorithm: "sliding_window", WindowSeconds: 30, OnLimit: "delay", MaxDelayMs: 500, MaxQueued: 3},
+		},
+		{
+			name:   "plan limits are left out",
+			client: &models.Client{ClientID: "a", PlanID: "basic", Capacity: 10, RatePerSec: 2, Algorithm: "token_bucket", WindowSeconds: 60},
+			want:   models.CreateClient{ClientID: "a", PlanID: "basic"},
+		},
+		{
+			name:   "overrides of a plan are kept",
+			client: &models.Client{ClientID: "a", PlanID: "basic", Capacity: 10, RatePerSec: 2, Algorithm: "token_bucket", WindowSeconds: 60, Overrides: []string{models.FieldCapacity, models.FieldAlgorithm}},
+			want:   models.CreateClient{ClientID: "a", PlanID: "basic", Capacity: 10, Algorithm: "token_bucket"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exportRow(tt.client); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("exportRow() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBulkRoundTrip checks that what the export writes is read back as the
+// same clients, in both formats.
+func TestBulkRoundTrip(t *testing.T) {
+	clients := []*models.CreateClient{
+		{ClientID: "a", Capacity: 10, RatePerSec: 2, Algorithm: "token_bucket", WindowSeconds: 60, OnLimit: "reject"},
+		{ClientID: "b, with \"quotes\"", ParentID: "a", PlanID: "basic", Shadow: true, OnLimit: "delay", MaxDelayMs: 250, MaxQueued: 5},
+		{ClientID: "c", RequestBytesPerSec: 1024, ResponseBytesPerSec: 2048},
+	}
+	want := make([]models.CreateClient, len(clients))
+	for i, client := range clients {
+		want[i] = *client
+	}
+
+	t.Run("ndjson", func(t *testing.T) {
+		var body bytes.Buffer
+		encoder := json.NewEncoder(&body)
+		for _, client := range clients {
+			if err := encoder.Encode(client); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rows, err := readNDJSONRows(&body)
+		if err != nil {
+			t.Fatalf("readNDJSONRows() error = %v", err)
+		}
+		checkRows(t, rows, want, []int{1, 2, 3}, []bool{false, false, false})
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		var body bytes.Buffer
+		cw := csv.NewWriter(&body)
+		header := make([]string, len(bulkColumns))
+		for i, column := range bulkColumns {
+			header[i] = column.name
+		}
+		cw.Write(header)
+		for _, client := range clients {
+			record := make([]string, len(bulkColumns))
+			for i, column := range bulkColumns {
+				record[i] = column.get(client)
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := readCSVRows(&body)
+		if err != nil {
+			t.Fatalf("readCSVRows() error = %v", err)
+		}
+		checkRows(t, rows, want, []int{2, 3, 4}, []bool{false, false, false})
+	})
+}
+
+func checkRows(t *testing.T, rows []*bulkRow, want []models.CreateClient, lines []int, invalid []bool) {
+	t.Helper()
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i, row := range rows {
+		if row.Line != lines[i] {
+			t.Errorf("row %d: line = %d, want %d", i, row.Line, lines[i])
+		}
+		if got := row.Status == bulkInvalid; got != invalid[i] {
+			t.Errorf("row %d: invalid = %v, want %v (error %q, params %v)", i, got, invalid[i], row.Error, row.InvalidParams)
+		}
+		if !invalid[i] && !reflect.DeepEqual(row.req, want[i]) {
+			t.Errorf("row %d: client = %+v, want %+v", i, row.req, want[i])
+		}
+	}
+}
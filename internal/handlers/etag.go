@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+// clientETag is the strong entity tag of a client's current version.
+func clientETag(client *models.Client) string {
+	return strconv.Quote(strconv.FormatInt(client.Version, 10))
+}
+
+// checkIfMatch reports whether the request's If-Match header, if any, names
+// the client's current version. It writes 412 Precondition Failed otherwise.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, client *models.Client) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	current := clientETag(client)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	slog.Info("Client version does not match", "client_id", client.ClientID, "if_match", header, "etag", current)
+	w.Header().Set("ETag", current)
+	problem.Write(w, r, http.StatusPreconditionFailed, fmt.Sprintf("Client with id %s has changed, current version is %s", client.ClientID, current))
+	return false
+}
+
+// sendUpdateError writes the response for a failed client update. A client
+// changed between reading and writing it fails the precondition when the
+// request had one and is a conflict otherwise.
+func sendUpdateError(w http.ResponseWriter, r *http.Request, clientID string, err error) {
+	if errors.Is(err, store.ErrVersionConflict) {
+		slog.Info("Client changed concurrently", "client_id", clientID)
+		if r.Header.Get("If-Match") != "" {
+			problem.Write(w, r, http.StatusPreconditionFailed, fmt.Sprintf("Client with id %s has changed", clientID))
+			return
+		}
+		problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Client with id %s was modified concurrently, retry the request", clientID))
+		return
+	}
+	slog.Error("Failed to update client", "client_id", clientID, "error", err)
+	problem.Write(w, r, http.StatusInternalServerError, "Failed to update client")
+}
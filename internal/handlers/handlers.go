@@ -2,38 +2,153 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/dorik33/cloud/internal/acl"
 	"github.com/dorik33/cloud/internal/config"
 	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/ratelimit"
 	"github.com/dorik33/cloud/internal/store"
 )
 
 type ClientHandler struct {
-	repo store.ClientRepository
-	cfg  *config.Config
+	repo   store.ClientRepository
+	quotas store.QuotaRepository
+	plans  store.PlanRepository
+	rl     *ratelimit.RateLimiter
+	acl    *acl.ACL
+	cfg    *config.Config
 }
 
-func NewClientHandler(repo store.ClientRepository, cfg *config.Config) *ClientHandler {
-	return &ClientHandler{repo: repo, cfg: cfg}
+func NewClientHandler(repo store.ClientRepository, quotas store.QuotaRepository, plans store.PlanRepository, rl *ratelimit.RateLimiter, acl *acl.ACL, cfg *config.Config) *ClientHandler {
+	return &ClientHandler{repo: repo, quotas: quotas, plans: plans, rl: rl, acl: acl, cfg: cfg}
 }
 
+// Page sizes of GetClientsHandler.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// GetClientsHandler returns a page of clients. The query parameters limit,
+// cursor, prefix, plan_id, created_from, created_to (RFC 3339), throttled, cost
+// (of the request throttled is judged by, the default cost unless given) and
+// sort (client_id, created_at or updated_at, prefixed with - for descending
+// order) select the page.
 func (h *ClientHandler) GetClientsHandler(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Handling get clients request", "method", r.Method, "path", r.URL.Path)
 
-	clients, err := h.repo.GetAllClients(r.Context())
+	query, err := parseClientQuery(r, h.cfg.RateLimit.DefaultCost)
+	if err != nil {
+		problem.BadRequest(w, r, err)
+		return
+	}
+
+	clients, next, err := h.repo.List(r.Context(), query)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		problem.Invalid(w, r, problem.Field("cursor", "is invalid"))
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to get clients", "error", err)
-		sendError(w, http.StatusInternalServerError, "Error with server")
+		problem.Write(w, r, http.StatusInternalServerError, "Error with server")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(clients)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.ClientPage{Clients: clients, NextCursor: next})
+}
+
+func parseClientQuery(r *http.Request, defaultCost int) (*models.ClientQuery, error) {
+	values := r.URL.Query()
+	query := &models.ClientQuery{
+		Limit:  defaultPageSize,
+		Cursor: values.Get("cursor"),
+		Prefix: values.Get("prefix"),
+		PlanID: values.Get("plan_id"),
+		Cost:   max(defaultCost, 1),
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return nil, problem.Field("limit", "must be between 1 and %d", maxPageSize)
+		}
+		query.Limit = limit
+	}
+	for name, dest := range map[string]*time.Time{"created_from": &query.CreatedFrom, "created_to": &query.CreatedTo} {
+		if value := values.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, problem.Field(name, "must be an RFC 3339 time")
+			}
+			*dest = parsed
+		}
+	}
+	if value := values.Get("throttled"); value != "" {
+		throttled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, problem.Field("throttled", "must be true or false")
+		}
+		query.Throttled = &throttled
+	}
+	if value := values.Get("cost"); value != "" {
+		cost, err := strconv.Atoi(value)
+		if err != nil || cost <= 0 {
+			return nil, problem.Field("cost", "must be greater than 0")
+		}
+		query.Cost = cost
+	}
+
+	sort := values.Get("sort")
+	if strings.HasPrefix(sort, "-") {
+		sort = sort[1:]
+		query.Desc = true
+	}
+	switch sort {
+	case "", store.SortClientID, store.SortCreatedAt, store.SortUpdatedAt:
+		query.Sort = sort
+	default:
+		return nil, problem.Field("sort", "must be client_id, created_at or updated_at")
+	}
+	return query, nil
+}
+
+func (h *ClientHandler) GetClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	slog.Debug("Getting client", "client_id", clientID)
+
+	client, err := h.repo.GetByID(r.Context(), clientID)
+	if err != nil {
+		slog.Error("Failed to get client", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
+		return
+	}
+	if client == nil {
+		slog.Error("Client not found", "client_id", clientID)
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+
+	quotas, err := h.quotas.GetByClient(r.Context(), clientID)
+	if err != nil {
+		slog.Error("Failed to get client quotas", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", clientETag(client))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.ClientWithQuotas{Client: client, Quotas: quotas})
 }
 
 func (h *ClientHandler) CreateClientHandler(w http.ResponseWriter, r *http.Request) {
@@ -42,98 +157,196 @@ func (h *ClientHandler) CreateClientHandler(w http.ResponseWriter, r *http.Reque
 	req := models.CreateClient{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		slog.Error("Failed to decode request body", "error", err)
-		sendError(w, http.StatusBadRequest, "Invalid request body")
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
+	invalid := validateClient(req.Algorithm, req.OnLimit, req.RequestBytesPerSec, req.ResponseBytesPerSec)
 	if req.ClientID == "" {
-		slog.Error("Client ID is required")
-		sendError(w, http.StatusBadRequest, "Client ID is required")
-		return
+		invalid = append([]problem.InvalidParam{problem.Field("client_id", "is required")}, invalid...)
 	}
-	if req.Capacity <= 0 {
-		req.Capacity = h.cfg.RateLimit.Capacity
-		slog.Debug("Using default capacity", "capacity", req.Capacity)
+	if len(invalid) > 0 {
+		slog.Error("Invalid client", "client_id", req.ClientID, "invalid", len(invalid))
+		problem.Invalid(w, r, invalid...)
+		return
 	}
-	if req.RatePerSec <= 0 {
-		req.RatePerSec = h.cfg.RateLimit.Rate
-		slog.Debug("Using default rate per second", "rate_per_sec", req.RatePerSec)
+	if req.ParentID != "" && !h.checkParent(w, r, req.ClientID, req.ParentID) {
+		return
 	}
 
-	client := &models.Client{
-		ClientID:   req.ClientID,
-		Capacity:   req.Capacity,
-		RatePerSec: req.RatePerSec,
-		Tokens:     req.Capacity,
-		LastRefill: time.Now(),
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+	var plan *models.Plan
+	if req.PlanID != "" {
+		var ok bool
+		if plan, ok = h.getPlan(w, r, req.PlanID); !ok {
+			return
+		}
 	}
+	client := h.newClient(&req, plan)
 
 	if err := h.repo.Create(r.Context(), client); err != nil {
+		if errors.Is(err, store.ErrClientExists) {
+			slog.Info("Client already exists", "client_id", req.ClientID)
+			problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Client with id %s already exists", req.ClientID))
+			return
+		}
 		slog.Error("Failed to create client", "client_id", req.ClientID, "error", err)
-		sendError(w, http.StatusInternalServerError, "Failed to create client")
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to create client")
 		return
 	}
+	h.rl.SetClient(client)
 
-	slog.Info("Client created", "client_id", client.ClientID, "capacity", client.Capacity, "rate_per_sec", client.RatePerSec)
+	slog.Info("Client created", "client_id", client.ClientID, "parent_id", client.ParentID, "plan_id", client.PlanID, "capacity", client.Capacity, "rate_per_sec", client.RatePerSec, "algorithm", client.Algorithm)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", clientETag(client))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(client)
 }
 
+// newClient builds a client with full tokens from a create request. Limits
+// the request leaves out come from plan, which must be the one it names, or
+// from the configured defaults when it names none.
+func (h *ClientHandler) newClient(req *models.CreateClient, plan *models.Plan) *models.Client {
+	client := &models.Client{
+		ClientID:            req.ClientID,
+		ParentID:            req.ParentID,
+		PlanID:              req.PlanID,
+		Capacity:            req.Capacity,
+		RatePerSec:          req.RatePerSec,
+		Algorithm:           req.Algorithm,
+		WindowSeconds:       req.WindowSeconds,
+		Shadow:              req.Shadow,
+		OnLimit:             req.OnLimit,
+		MaxDelayMs:          req.MaxDelayMs,
+		MaxQueued:           req.MaxQueued,
+		RequestBytesPerSec:  req.RequestBytesPerSec,
+		ResponseBytesPerSec: req.ResponseBytesPerSec,
+		LastRefill:          time.Now(),
+		CreatedAt:           time.Now(),
+		UpdatedAt:           time.Now(),
+	}
+
+	if plan != nil {
+		client.Overrides = suppliedFields(req.Capacity, req.RatePerSec, req.Algorithm, req.WindowSeconds)
+		applyPlan(client, plan)
+	} else {
+		if client.Capacity <= 0 {
+			client.Capacity = h.cfg.RateLimit.Capacity
+			slog.Debug("Using default capacity", "capacity", client.Capacity)
+		}
+		if client.RatePerSec <= 0 {
+			client.RatePerSec = h.cfg.RateLimit.Rate
+			slog.Debug("Using default rate per second", "rate_per_sec", client.RatePerSec)
+		}
+		if client.Algorithm == "" {
+			client.Algorithm = h.cfg.RateLimit.Algorithm
+		}
+		if client.WindowSeconds <= 0 {
+			client.WindowSeconds = h.cfg.RateLimit.WindowSeconds
+		}
+	}
+	h.applyOnLimitDefaults(client)
+	client.Tokens = client.Capacity
+	return client
+}
+
+// UpdateClientHandler replaces a client's settings with the request body.
+// Fields left out are cleared or take their defaults; PatchClientHandler
+// changes only the fields it is given.
 func (h *ClientHandler) UpdateClientHandler(w http.ResponseWriter, r *http.Request) {
 	clientID := r.PathValue("client_id")
 	slog.Debug("Updating client", "client_id", clientID)
 
-	var req struct {
-		Capacity   int `json:"capacity"`
-		RatePerSec int `json:"rate_per_sec"`
-	}
+	req := models.UpdateClient{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		slog.Error("Failed to decode request body", "client_id", clientID, "error", err)
-		sendError(w, http.StatusBadRequest, "Invalid request body")
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	if req.Capacity <= 0 {
-		slog.Error("Capacity must be greater than 0", "client_id", clientID, "capacity", req.Capacity)
-		sendError(w, http.StatusBadRequest, "Capacity must be greater than 0")
-		return
-	}
-	if req.RatePerSec <= 0 {
-		slog.Error("Rate per second must be greater than 0", "client_id", clientID, "rate_per_sec", req.RatePerSec)
-		sendError(w, http.StatusBadRequest, "Rate per second must be greater than 0")
+	if invalid := validateClient(req.Algorithm, req.OnLimit, req.RequestBytesPerSec, req.ResponseBytesPerSec); len(invalid) > 0 {
+		slog.Error("Invalid client", "client_id", clientID, "invalid", len(invalid))
+		problem.Invalid(w, r, invalid...)
 		return
 	}
 
 	client, err := h.repo.GetByID(r.Context(), clientID)
 	if err != nil {
 		slog.Error("Failed to get client", "client_id", clientID, "error", err)
-		sendError(w, http.StatusInternalServerError, "Failed to get client")
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
 		return
 	}
 	if client == nil {
 		slog.Error("Client not found", "client_id", clientID)
-		sendError(w, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+	if !checkIfMatch(w, r, client) {
 		return
 	}
+	previous := *client
 
-	client.Capacity = req.Capacity
-	client.RatePerSec = req.RatePerSec
-	if client.Tokens > req.Capacity {
-		client.Tokens = req.Capacity
+	// PUT replaces the client, so a parent or plan left out is removed.
+	if req.ParentID != client.ParentID {
+		if req.ParentID != "" && !h.checkParent(w, r, clientID, req.ParentID) {
+			return
+		}
+		client.ParentID = req.ParentID
 	}
-	client.LastRefill = time.Now()
+	client.Shadow = req.Shadow
+	client.OnLimit = req.OnLimit
+	client.MaxDelayMs = req.MaxDelayMs
+	client.MaxQueued = req.MaxQueued
+	client.RequestBytesPerSec = req.RequestBytesPerSec
+	client.ResponseBytesPerSec = req.ResponseBytesPerSec
+	h.applyOnLimitDefaults(client)
+	client.PlanID = req.PlanID
+	if client.PlanID != "" {
+		plan, ok := h.getPlan(w, r, client.PlanID)
+		if !ok {
+			return
+		}
+		client.Capacity = req.Capacity
+		client.RatePerSec = req.RatePerSec
+		client.Algorithm = req.Algorithm
+		client.WindowSeconds = req.WindowSeconds
+		client.Overrides = suppliedFields(req.Capacity, req.RatePerSec, req.Algorithm, req.WindowSeconds)
+		applyPlan(client, plan)
+	} else {
+		var invalid []problem.InvalidParam
+		if req.Capacity <= 0 {
+			invalid = append(invalid, problem.Field(models.FieldCapacity, "must be greater than 0"))
+		}
+		if req.RatePerSec <= 0 {
+			invalid = append(invalid, problem.Field(models.FieldRatePerSec, "must be greater than 0"))
+		}
+		if len(invalid) > 0 {
+			slog.Error("Invalid client limits", "client_id", clientID, "capacity", req.Capacity, "rate_per_sec", req.RatePerSec)
+			problem.Invalid(w, r, invalid...)
+			return
+		}
+		client.Overrides = nil
+		client.Capacity = req.Capacity
+		client.RatePerSec = req.RatePerSec
+		client.Algorithm = req.Algorithm
+		if client.Algorithm == "" {
+			client.Algorithm = h.cfg.RateLimit.Algorithm
+		}
+		client.WindowSeconds = req.WindowSeconds
+		if client.WindowSeconds <= 0 {
+			client.WindowSeconds = h.cfg.RateLimit.WindowSeconds
+		}
+	}
+	resetOnAlgorithmChange(client, &previous)
 
 	if err := h.repo.Update(r.Context(), client); err != nil {
-		slog.Error("Failed to update client", "client_id", clientID, "error", err)
-		sendError(w, http.StatusInternalServerError, "Failed to update client")
+		sendUpdateError(w, r, clientID, err)
 		return
 	}
+	h.rl.SetClient(client)
 
-	slog.Info("Client updated", "client_id", client.ClientID, "capacity", client.Capacity, "rate_per_sec", client.RatePerSec)
+	slog.Info("Client updated", "client_id", client.ClientID, "parent_id", client.ParentID, "plan_id", client.PlanID, "capacity", client.Capacity, "rate_per_sec", client.RatePerSec, "algorithm", client.Algorithm, "version", client.Version)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", clientETag(client))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(client)
 }
@@ -142,12 +355,91 @@ func (h *ClientHandler) DeleteClientHandler(w http.ResponseWriter, r *http.Reque
 	clientID := r.PathValue("client_id")
 	slog.Debug("Deleting client", "client_id", clientID)
 
-	if err := h.repo.Delete(r.Context(), clientID); err != nil {
+	deleted, err := h.repo.Delete(r.Context(), clientID)
+	if errors.Is(err, store.ErrClientHasChildren) {
+		problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Client %s still has child clients", clientID))
+		return
+	}
+	if err != nil {
 		slog.Error("Failed to delete client", "client_id", clientID, "error", err)
-		sendError(w, http.StatusInternalServerError, "Failed to delete client")
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to delete client")
 		return
 	}
+	if !deleted {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+	h.rl.RemoveClient(clientID)
+	// The client's acl rules were deleted with it.
+	if err := h.acl.Load(r.Context()); err != nil {
+		slog.Error("Failed to reload acl", "error", err)
+	}
 
 	slog.Info("Client deleted", "client_id", clientID)
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// validateClient checks the client fields that are valid or not on their own.
+func validateClient(algorithm, onLimit string, requestBytesPerSec, responseBytesPerSec int) []problem.InvalidParam {
+	var invalid []problem.InvalidParam
+	if algorithm != "" && !ratelimit.ValidAlgorithm(algorithm) {
+		invalid = append(invalid, problem.Field(models.FieldAlgorithm, "is unknown: %s", algorithm))
+	}
+	if onLimit != "" && !ratelimit.ValidOnLimit(onLimit) {
+		invalid = append(invalid, problem.Field("on_limit", "must be reject or delay"))
+	}
+	if requestBytesPerSec < 0 {
+		invalid = append(invalid, problem.Field("request_bytes_per_sec", "must not be negative"))
+	}
+	if responseBytesPerSec < 0 {
+		invalid = append(invalid, problem.Field("response_bytes_per_sec", "must not be negative"))
+	}
+	return invalid
+}
+
+// applyOnLimitDefaults rejects over-limit requests unless the client asked
+// for delays, and fills in the configured wait and queue bounds for those that
+// did.
+func (h *ClientHandler) applyOnLimitDefaults(client *models.Client) {
+	if client.OnLimit == "" {
+		client.OnLimit = ratelimit.OnLimitReject
+	}
+	if client.OnLimit != ratelimit.OnLimitDelay {
+		client.MaxDelayMs = 0
+		client.MaxQueued = 0
+		return
+	}
+	if client.MaxDelayMs <= 0 {
+		client.MaxDelayMs = int(h.cfg.RateLimit.MaxDelay.Milliseconds())
+	}
+	if client.MaxQueued <= 0 {
+		client.MaxQueued = h.cfg.RateLimit.MaxQueued
+	}
+}
+
+// checkParent verifies that parentID exists, is not clientID or one of its
+// descendants and leaves room for another level below it, writing the error
+// response when it does not.
+func (h *ClientHandler) checkParent(w http.ResponseWriter, r *http.Request, clientID, parentID string) bool {
+	chain, err := h.repo.GetChain(r.Context(), parentID)
+	if err != nil {
+		slog.Error("Failed to get parent client", "client_id", clientID, "parent_id", parentID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get parent client")
+		return false
+	}
+	if len(chain) == 0 {
+		problem.Invalid(w, r, problem.Field("parent_id", "refers to unknown client %s", parentID))
+		return false
+	}
+	for _, ancestor := range chain {
+		if ancestor.ClientID == clientID {
+			problem.Invalid(w, r, problem.Field("parent_id", "would make client %s its own ancestor", clientID))
+			return false
+		}
+	}
+	if len(chain) >= models.MaxChainDepth {
+		problem.Invalid(w, r, problem.Field("parent_id", "would make the hierarchy deeper than %d levels", models.MaxChainDepth))
+		return false
+	}
+	return true
+}
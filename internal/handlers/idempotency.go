@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dorik33/cloud/internal/auth"
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+const (
+	maxIdempotencyKeyLength = 255
+	// idempotencyLockTimeout is how long a key stays claimed by a request
+	// that never finished, e.g. because the instance handling it died.
+	idempotencyLockTimeout = time.Minute
+)
+
+// replayedHeaders are the response headers stored with an idempotency key.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// Idempotency replays the stored response to a request that repeats the
+// Idempotency-Key of an earlier one, so that clients can safely retry.
+type Idempotency struct {
+	repo store.IdempotencyRepository
+	cfg  config.IdempotencyConfig
+}
+
+func NewIdempotency(repo store.IdempotencyRepository, cfg config.IdempotencyConfig) *Idempotency {
+	return &Idempotency{repo: repo, cfg: cfg}
+}
+
+// Start deletes expired keys every hour until ctx is done.
+func (i *Idempotency) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deleted, err := i.repo.DeleteExpired(ctx)
+				if err != nil {
+					slog.Error("Failed to delete expired idempotency keys", "error", err)
+					continue
+				}
+				slog.Debug("Deleted expired idempotency keys", "count", deleted)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Wrap runs next once per Idempotency-Key of a caller. A repeat with the same method,
+// path and body gets the first response again, one with a different request
+// gets 422, and one arriving while the first is still handled gets 409.
+// Server errors are not stored, so the retry runs again. Requests without
+// the header are passed through.
+func (i *Idempotency) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			problem.Invalid(w, r, problem.Field("Idempotency-Key", "must be at most %d characters", maxIdempotencyKeyLength))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			slog.Error("Failed to read request body", "error", err)
+			problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := requestHash(r, body)
+		scope := idempotencyScope(r)
+
+		now := time.Now()
+		stored, err := i.repo.Claim(r.Context(), scope, key, hash, now.Add(i.cfg.Retention), now.Add(-idempotencyLockTimeout))
+		if err != nil {
+			slog.Error("Failed to claim idempotency key", "key", key, "error", err)
+			problem.Write(w, r, http.StatusInternalServerError, "Failed to check idempotency key")
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.RequestHash != hash:
+				slog.Info("Idempotency key reused with a different request", "key", key)
+				problem.Write(w, r, http.StatusUnprocessableEntity, "Idempotency key was already used with a different request")
+			case stored.Status == 0:
+				w.Header().Set("Retry-After", "1")
+				problem.Write(w, r, http.StatusConflict, "A request with this idempotency key is still being processed")
+			default:
+				slog.Info("Replaying response", "key", key, "status", stored.Status)
+				for name, value := range stored.Headers {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.Status)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		// The response is already sent; storing it must not depend on the
+		// client still waiting.
+		ctx := context.WithoutCancel(r.Context())
+		if rec.status >= http.StatusInternalServerError {
+			if err := i.repo.Release(ctx, scope, key); err != nil {
+				slog.Error("Failed to release idempotency key", "key", key, "error", err)
+			}
+			return
+		}
+		headers := map[string]string{}
+		for _, name := range replayedHeaders {
+			if value := w.Header().Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+		if err := i.repo.Complete(ctx, scope, key, rec.status, headers, rec.body.Bytes()); err != nil {
+			slog.Error("Failed to store idempotent response", "key", key, "error", err)
+		}
+	}
+}
+
+// idempotencyScope is the key space of the request's caller: the id of the
+// admin token it was authenticated with, 0 for the bootstrap token.
+func idempotencyScope(r *http.Request) string {
+	if token := auth.FromContext(r.Context()); token != nil {
+		return strconv.FormatInt(token.ID, 10)
+	}
+	return ""
+}
+
+// requestHash identifies a request by its method, path and body.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the status and body written through it.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/ratelimit"
+)
+
+// PatchClientHandler applies a JSON Merge Patch (RFC 7396) to a client. Only
+// the fields present are validated and changed. A null limit field drops the
+// client's override of its plan, or restores the configured default when it
+// has no plan; a null plan_id or parent_id detaches the client.
+func (h *ClientHandler) PatchClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	slog.Debug("Patching client", "client_id", clientID)
+
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil ||
+		(mediaType != "application/merge-patch+json" && mediaType != "application/json") {
+		problem.Write(w, r, http.StatusUnsupportedMediaType, "Content type must be application/merge-patch+json")
+		return
+	}
+
+	patch := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		slog.Error("Failed to decode request body", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	client, err := h.repo.GetByID(r.Context(), clientID)
+	if err != nil {
+		slog.Error("Failed to get client", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
+		return
+	}
+	if client == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+	if !checkIfMatch(w, r, client) {
+		return
+	}
+	previous := *client
+	previous.Overrides = slices.Clone(client.Overrides)
+
+	if err := h.applyPatch(client, patch); err != nil {
+		problem.BadRequest(w, r, err)
+		return
+	}
+
+	if client.ParentID != "" && client.ParentID != previous.ParentID && !h.checkParent(w, r, clientID, client.ParentID) {
+		return
+	}
+	if client.PlanID != "" {
+		plan, ok := h.getPlan(w, r, client.PlanID)
+		if !ok {
+			return
+		}
+		applyPlan(client, plan)
+	}
+	h.applyOnLimitDefaults(client)
+	resetOnAlgorithmChange(client, &previous)
+
+	if err := h.repo.Update(r.Context(), client); err != nil {
+		sendUpdateError(w, r, clientID, err)
+		return
+	}
+	h.rl.SetClient(client)
+
+	slog.Info("Client patched", "client_id", client.ClientID, "fields", len(patch), "parent_id", client.ParentID, "plan_id", client.PlanID, "capacity", client.Capacity, "rate_per_sec", client.RatePerSec, "algorithm", client.Algorithm, "version", client.Version)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", clientETag(client))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(client)
+}
+
+// applyPatch copies the fields of a merge patch into the client, checking
+// each one on its own. Plan and parent references are checked by the caller.
+func (h *ClientHandler) applyPatch(client *models.Client, patch map[string]json.RawMessage) error {
+	defaults := h.cfg.RateLimit
+
+	// The plan goes first, so the limit fields below know whether they
+	// override it.
+	if raw, ok := patch["plan_id"]; ok {
+		planID, null, err := patchValue[string](raw, "plan_id")
+		if err != nil {
+			return err
+		}
+		if null || planID == "" {
+			client.PlanID = ""
+			client.Overrides = nil
+		} else if planID != client.PlanID {
+			if client.PlanID == "" {
+				client.Overrides = nil
+			}
+			client.PlanID = planID
+		}
+	}
+
+	for field, raw := range patch {
+		switch field {
+		case "plan_id":
+		case "parent_id":
+			parentID, _, err := patchValue[string](raw, field)
+			if err != nil {
+				return err
+			}
+			client.ParentID = parentID
+		case models.FieldCapacity:
+			capacity, null, err := patchValue[int](raw, field)
+			if err != nil {
+				return err
+			}
+			if !null && capacity <= 0 {
+				return problem.Field(field, "must be greater than 0")
+			}
+			client.Capacity = patchLimit(client, field, null, capacity, defaults.Capacity)
+		case models.FieldRatePerSec:
+			rate, null, err := patchValue[int](raw, field)
+			if err != nil {
+				return err
+			}
+			if !null && rate <= 0 {
+				return problem.Field(field, "must be greater than 0")
+			}
+			client.RatePerSec = patchLimit(client, field, null, rate, defaults.Rate)
+		case models.FieldAlgorithm:
+			algorithm, null, err := patchValue[string](raw, field)
+			if err != nil {
+				return err
+			}
+			if !null && !ratelimit.ValidAlgorithm(algorithm) {
+				return problem.Field(field, "is unknown: %s", algorithm)
+			}
+			client.Algorithm = patchLimit(client, field, null, algorithm, defaults.Algorithm)
+		case models.FieldWindowSeconds:
+			window, null, err := patchValue[int](raw, field)
+			if err != nil {
+				return err
+			}
+			if !null && window <= 0 {
+				return problem.Field(field, "must be greater than 0")
+			}
+			client.WindowSeconds = patchLimit(client, field, null, window, defaults.WindowSeconds)
+		case "shadow":
+			shadow, _, err := patchValue[bool](raw, field)
+			if err != nil {
+				return err
+			}
+			client.Shadow = shadow
+		case "on_limit":
+			onLimit, _, err := patchValue[string](raw, field)
+			if err != nil {
+				return err
+			}
+			if onLimit != "" && !ratelimit.ValidOnLimit(onLimit) {
+				return problem.Field(field, "must be reject or delay")
+			}
+			client.OnLimit = onLimit
+		case "max_delay_ms", "max_queued", "request_bytes_per_sec", "response_bytes_per_sec":
+			value, _, err := patchValue[int](raw, field)
+			if err != nil {
+				return err
+			}
+			if value < 0 {
+				return problem.Field(field, "must not be negative")
+			}
+			switch field {
+			case "max_delay_ms":
+				client.MaxDelayMs = value
+			case "max_queued":
+				client.MaxQueued = value
+			case "request_bytes_per_sec":
+				client.RequestBytesPerSec = value
+			case "response_bytes_per_sec":
+				client.ResponseBytesPerSec = value
+			}
+		default:
+			return problem.Field(field, "cannot be patched")
+		}
+	}
+	return nil
+}
+
+// patchValue decodes one field of a merge patch, reporting whether it was
+// null. A null field yields the zero value.
+func patchValue[T any](raw json.RawMessage, field string) (T, bool, error) {
+	var value T
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return value, true, nil
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return value, false, problem.Field(field, "has an invalid value")
+	}
+	return value, false, nil
+}
+
+// patchLimit returns the new value of a limit field. On a client with a plan
+// a value becomes an override and null drops the override, leaving the field
+// to applyPlan; without a plan null restores the configured default.
+func patchLimit[T any](client *models.Client, field string, null bool, value, fallback T) T {
+	if client.PlanID == "" {
+		if null {
+			return fallback
+		}
+		return value
+	}
+	client.Overrides = slices.DeleteFunc(client.Overrides, func(f string) bool { return f == field })
+	if null {
+		return value
+	}
+	client.Overrides = append(client.Overrides, field)
+	return value
+}
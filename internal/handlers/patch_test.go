@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+)
+
+func TestApplyPatch(t *testing.T) {
+	h := &ClientHandler{cfg: &config.Config{RateLimit: config.RateLimitConfig{
+		Capacity:      100,
+		Rate:          1,
+		Algorithm:     "token_bucket",
+		WindowSeconds: 60,
+	}}}
+	standalone := func() *models.Client {
+		return &models.Client{ClientID: "user1", Capacity: 30, RatePerSec: 5, Algorithm: "token_bucket", WindowSeconds: 60, OnLimit: "reject"}
+	}
+	onPlan := func() *models.Client {
+		c := standalone()
+		c.PlanID = "basic"
+		c.Overrides = []string{models.FieldCapacity}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		client  func() *models.Client
+		patch   string
+		check   func(*models.Client) bool
+		invalid string
+	}{
+		{
+			name: "sets present fields only", client: standalone,
+			patch: `{"capacity": 50, "shadow": true}`,
+			check: func(c *models.Client) bool { return c.Capacity == 50 && c.Shadow && c.RatePerSec == 5 },
+		},
+		{
+			name: "null restores the default without a plan", client: standalone,
+			patch: `{"capacity": null, "rate_per_sec": null}`,
+			check: func(c *models.Client) bool { return c.Capacity == 100 && c.RatePerSec == 1 },
+		},
+		{
+			name: "value on a plan becomes an override", client: onPlan,
+			patch: `{"rate_per_sec": 7}`,
+			check: func(c *models.Client) bool {
+				return c.RatePerSec == 7 && slices.Contains(c.Overrides, models.FieldRatePerSec) && slices.Contains(c.Overrides, models.FieldCapacity)
+			},
+		},
+		{
+			name: "null on a plan drops the override", client: onPlan,
+			patch: `{"capacity": null}`,
+			check: func(c *models.Client) bool { return len(c.Overrides) == 0 },
+		},
+		{
+			name: "null plan detaches the client", client: onPlan,
+			patch: `{"plan_id": null}`,
+			check: func(c *models.Client) bool { return c.PlanID == "" && len(c.Overrides) == 0 },
+		},
+		{
+			name: "joining a plan starts without overrides", client: standalone,
+			patch: `{"plan_id": "pro", "capacity": 10}`,
+			check: func(c *models.Client) bool {
+				return c.PlanID == "pro" && c.Capacity == 10 && slices.Equal(c.Overrides, []string{models.FieldCapacity})
+			},
+		},
+		{
+			name: "null parent detaches the client", client: func() *models.Client { c := standalone(); c.ParentID = "org"; return c },
+			patch: `{"parent_id": null}`,
+			check: func(c *models.Client) bool { return c.ParentID == "" },
+		},
+		{
+			name: "bandwidth fields", client: standalone,
+			patch: `{"request_bytes_per_sec": 1024, "response_bytes_per_sec": 0, "max_delay_ms": 250, "max_queued": 3}`,
+			check: func(c *models.Client) bool {
+				return c.RequestBytesPerSec == 1024 && c.MaxDelayMs == 250 && c.MaxQueued == 3
+			},
+		},
+		{name: "non-positive capacity", client: standalone, patch: `{"capacity": 0}`, invalid: "capacity"},
+		{name: "wrong type", client: standalone, patch: `{"rate_per_sec": "fast"}`, invalid: "rate_per_sec"},
+		{name: "unknown algorithm", client: standalone, patch: `{"algorithm": "magic"}`, invalid: "algorithm"},
+		{name: "bad on_limit", client: standalone, patch: `{"on_limit": "drop"}`, invalid: "on_limit"},
+		{name: "negative bandwidth", client: standalone, patch: `{"request_bytes_per_sec": -1}`, invalid: "request_bytes_per_sec"},
+		{name: "read-only field", client: standalone, patch: `{"tokens": 5}`, invalid: "tokens"},
+	}
+	for _, tt := range tests {
+		patch := map[string]json.RawMessage{}
+		if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+			t.Fatalf("%s: bad patch: %v", tt.name, err)
+		}
+		client := tt.client()
+		err := h.applyPatch(client, patch)
+
+		if tt.invalid != "" {
+			var param problem.InvalidParam
+			if !errors.As(err, &param) || param.Name != tt.invalid {
+				t.Errorf("%s: applyPatch error = %v, want invalid %s", tt.name, err, tt.invalid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: applyPatch error: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(client) {
+			t.Errorf("%s: unexpected client %+v", tt.name, client)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/ratelimit"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type PlanHandler struct {
+	repo store.PlanRepository
+	rl   *ratelimit.RateLimiter
+	cfg  *config.Config
+}
+
+func NewPlanHandler(repo store.PlanRepository, rl *ratelimit.RateLimiter, cfg *config.Config) *PlanHandler {
+	return &PlanHandler{repo: repo, rl: rl, cfg: cfg}
+}
+
+func (h *PlanHandler) GetPlansHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling get plans request", "method", r.Method, "path", r.URL.Path)
+
+	plans, err := h.repo.GetAll(r.Context())
+	if err != nil {
+		slog.Error("Failed to get plans", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Error with server")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(plans)
+}
+
+func (h *PlanHandler) GetPlanHandler(w http.ResponseWriter, r *http.Request) {
+	planID := r.PathValue("plan_id")
+	slog.Debug("Getting plan", "plan_id", planID)
+
+	plan, err := h.repo.GetByID(r.Context(), planID)
+	if err != nil {
+		slog.Error("Failed to get plan", "plan_id", planID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get plan")
+		return
+	}
+	if plan == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Plan with id %s not found", planID))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (h *PlanHandler) CreatePlanHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling create plan request", "method", r.Method, "path", r.URL.Path)
+
+	req := models.CreatePlan{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.PlanID == "" {
+		problem.Invalid(w, r, problem.Field("plan_id", "is required"))
+		return
+	}
+
+	plan := &models.Plan{
+		PlanID:        req.PlanID,
+		Capacity:      req.Capacity,
+		RatePerSec:    req.RatePerSec,
+		Algorithm:     req.Algorithm,
+		WindowSeconds: req.WindowSeconds,
+	}
+	if err := h.validate(plan); err != nil {
+		problem.BadRequest(w, r, err)
+		return
+	}
+
+	err := h.repo.Create(r.Context(), plan)
+	if errors.Is(err, store.ErrPlanExists) {
+		problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Plan with id %s already exists", req.PlanID))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create plan", "plan_id", req.PlanID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to create plan")
+		return
+	}
+
+	slog.Info("Plan created", "plan_id", plan.PlanID, "capacity", plan.Capacity, "rate_per_sec", plan.RatePerSec, "algorithm", plan.Algorithm)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (h *PlanHandler) UpdatePlanHandler(w http.ResponseWriter, r *http.Request) {
+	planID := r.PathValue("plan_id")
+	slog.Debug("Updating plan", "plan_id", planID)
+
+	req := models.UpdatePlan{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "plan_id", planID, "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	plan := &models.Plan{
+		PlanID:        planID,
+		Capacity:      req.Capacity,
+		RatePerSec:    req.RatePerSec,
+		Algorithm:     req.Algorithm,
+		WindowSeconds: req.WindowSeconds,
+	}
+	if err := h.validate(plan); err != nil {
+		problem.BadRequest(w, r, err)
+		return
+	}
+
+	clients, err := h.repo.Update(r.Context(), plan)
+	if errors.Is(err, store.ErrPlanNotFound) {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Plan with id %s not found", planID))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update plan", "plan_id", planID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to update plan")
+		return
+	}
+	for _, client := range clients {
+		h.rl.SetClient(client)
+	}
+
+	slog.Info("Plan updated", "plan_id", plan.PlanID, "capacity", plan.Capacity, "rate_per_sec", plan.RatePerSec, "algorithm", plan.Algorithm, "clients", len(clients))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(plan)
+}
+
+func (h *PlanHandler) DeletePlanHandler(w http.ResponseWriter, r *http.Request) {
+	planID := r.PathValue("plan_id")
+	slog.Debug("Deleting plan", "plan_id", planID)
+
+	deleted, err := h.repo.Delete(r.Context(), planID)
+	if errors.Is(err, store.ErrPlanInUse) {
+		problem.Write(w, r, http.StatusConflict, fmt.Sprintf("Plan %s is still used by clients", planID))
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to delete plan", "plan_id", planID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to delete plan")
+		return
+	}
+	if !deleted {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Plan with id %s not found", planID))
+		return
+	}
+
+	slog.Info("Plan deleted", "plan_id", planID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PlanHandler) validate(plan *models.Plan) error {
+	if plan.Capacity <= 0 {
+		return problem.Field(models.FieldCapacity, "must be greater than 0")
+	}
+	if plan.RatePerSec <= 0 {
+		return problem.Field(models.FieldRatePerSec, "must be greater than 0")
+	}
+	if plan.Algorithm == "" {
+		plan.Algorithm = h.cfg.RateLimit.Algorithm
+	}
+	if !ratelimit.ValidAlgorithm(plan.Algorithm) {
+		return problem.Field(models.FieldAlgorithm, "is unknown: %s", plan.Algorithm)
+	}
+	if plan.WindowSeconds <= 0 {
+		plan.WindowSeconds = h.cfg.RateLimit.WindowSeconds
+	}
+	return nil
+}
+
+// getPlan loads a plan a client refers to, writing the error response when it
+// cannot.
+func (h *ClientHandler) getPlan(w http.ResponseWriter, r *http.Request, planID string) (*models.Plan, bool) {
+	plan, err := h.plans.GetByID(r.Context(), planID)
+	if err != nil {
+		slog.Error("Failed to get plan", "plan_id", planID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get plan")
+		return nil, false
+	}
+	if plan == nil {
+		problem.Invalid(w, r, problem.Field("plan_id", "refers to unknown plan %s", planID))
+		return nil, false
+	}
+	return plan, true
+}
+
+// suppliedFields lists the limits a request sets explicitly, which become the
+// client's overrides of its plan.
+func suppliedFields(capacity, ratePerSec int, algorithm string, windowSeconds int) []string {
+	fields := []string{}
+	if capacity > 0 {
+		fields = append(fields, models.FieldCapacity)
+	}
+	if ratePerSec > 0 {
+		fields = append(fields, models.FieldRatePerSec)
+	}
+	if algorithm != "" {
+		fields = append(fields, models.FieldAlgorithm)
+	}
+	if windowSeconds > 0 {
+		fields = append(fields, models.FieldWindowSeconds)
+	}
+	return fields
+}
+
+// applyPlan copies the plan's limits into every field the client does not
+// override.
+func applyPlan(client *models.Client, plan *models.Plan) {
+	if !slices.Contains(client.Overrides, models.FieldCapacity) {
+		client.Capacity = plan.Capacity
+	}
+	if !slices.Contains(client.Overrides, models.FieldRatePerSec) {
+		client.RatePerSec = plan.RatePerSec
+	}
+	if !slices.Contains(client.Overrides, models.FieldAlgorithm) {
+		client.Algorithm = plan.Algorithm
+	}
+	if !slices.Contains(client.Overrides, models.FieldWindowSeconds) {
+		client.WindowSeconds = plan.WindowSeconds
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/ratelimit"
+)
+
+func (h *ClientHandler) SetQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	period := r.PathValue("period")
+	slog.Debug("Setting client quota", "client_id", clientID, "period", period)
+
+	if !ratelimit.ValidQuotaPeriod(period) {
+		problem.Invalid(w, r, problem.Field("period", "must be day or month"))
+		return
+	}
+
+	req := models.SetQuota{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Limit <= 0 {
+		problem.Invalid(w, r, problem.Field("limit", "must be greater than 0"))
+		return
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(req.Timezone); err != nil {
+		problem.Invalid(w, r, problem.Field("timezone", "is unknown: %s", req.Timezone))
+		return
+	}
+
+	client, err := h.repo.GetByID(r.Context(), clientID)
+	if err != nil {
+		slog.Error("Failed to get client", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
+		return
+	}
+	if client == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+
+	quota := &models.Quota{ClientID: clientID, Period: period, Limit: req.Limit, Timezone: req.Timezone}
+	if err := h.quotas.Set(r.Context(), quota); err != nil {
+		slog.Error("Failed to set client quota", "client_id", clientID, "period", period, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to set quota")
+		return
+	}
+
+	slog.Info("Client quota set", "client_id", clientID, "period", period, "limit", quota.Limit, "timezone", quota.Timezone)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(quota)
+}
+
+func (h *ClientHandler) DeleteQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	period := r.PathValue("period")
+	slog.Debug("Deleting client quota", "client_id", clientID, "period", period)
+
+	deleted, err := h.quotas.Delete(r.Context(), clientID, period)
+	if err != nil {
+		slog.Error("Failed to delete client quota", "client_id", clientID, "period", period, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to delete quota")
+		return
+	}
+	if !deleted {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client %s has no %s quota", clientID, period))
+		return
+	}
+
+	slog.Info("Client quota deleted", "client_id", clientID, "period", period)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type ShadowHandler struct {
+	repo store.ShadowRepository
+}
+
+func NewShadowHandler(repo store.ShadowRepository) *ShadowHandler {
+	return &ShadowHandler{repo: repo}
+}
+
+// GetDenialsHandler lists the clients whose requests shadow mode let through
+// between the from and to query parameters (RFC 3339), the last 24 hours by
+// default.
+func (h *ShadowHandler) GetDenialsHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling get shadow denials request", "method", r.Method, "path", r.URL.Path)
+
+	from, to, ok := parseTimeRange(w, r, 24*time.Hour)
+	if !ok {
+		return
+	}
+
+	reports, err := h.repo.Report(r.Context(), from, to)
+	if err != nil {
+		slog.Error("Failed to get shadow denials", "from", from, "to", to, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Error with server")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(reports)
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/ratelimit"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+// Token actions that change the client record rather than its bucket.
+const (
+	tokensOverride      = "override"
+	tokensClearOverride = "clear_override"
+)
+
+// maxOverrideDuration bounds how long a temporary limit may last.
+const maxOverrideDuration = 30 * 24 * time.Hour
+
+// TokensHandler applies an administrative action to a client: reset fills its
+// bucket, add credits tokens, drain empties it, override raises or lowers its
+// limits until the given duration has passed and clear_override drops such a
+// limit early.
+func (h *ClientHandler) TokensHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	slog.Debug("Changing client tokens", "client_id", clientID)
+
+	req := models.TokensRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		slog.Error("Failed to decode request body", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	switch req.Action {
+	case ratelimit.TokensReset, ratelimit.TokensDrain:
+	case ratelimit.TokensAdd:
+		if req.Tokens <= 0 {
+			problem.Invalid(w, r, problem.Field("tokens", "must be greater than 0"))
+			return
+		}
+	case tokensOverride, tokensClearOverride:
+		h.setTemporaryLimit(w, r, clientID, &req)
+		return
+	default:
+		problem.Invalid(w, r, problem.Field("action", "must be reset, add, drain, override or clear_override"))
+		return
+	}
+
+	client, err := h.rl.ChangeTokens(r.Context(), clientID, req.Action, req.Tokens)
+	if err != nil {
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to change client tokens")
+		return
+	}
+	if client == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+
+	slog.Info("Client tokens changed", "client_id", clientID, "action", req.Action, "tokens", client.Tokens, "applied_by", actor(r), "reason", req.Reason)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", clientETag(client))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(client)
+}
+
+// setTemporaryLimit stores or clears a client's temporary limit and hands the
+// client to the limiter. The write fails if the client changed after it was
+// read and checked against If-Match.
+func (h *ClientHandler) setTemporaryLimit(w http.ResponseWriter, r *http.Request, clientID string, req *models.TokensRequest) {
+	client, err := h.repo.GetByID(r.Context(), clientID)
+	if err != nil {
+		slog.Error("Failed to get client", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
+		return
+	}
+	if client == nil {
+		slog.Error("Client not found", "client_id", clientID)
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+	if !checkIfMatch(w, r, client) {
+		return
+	}
+
+	var limit *models.TemporaryLimit
+	if req.Action == tokensOverride {
+		var invalid []problem.InvalidParam
+		limit, invalid = temporaryLimit(client, req, time.Now())
+		if len(invalid) > 0 {
+			slog.Error("Invalid temporary limit", "client_id", clientID, "invalid", len(invalid))
+			problem.Invalid(w, r, invalid...)
+			return
+		}
+		limit.AppliedBy = actor(r)
+		limit.Reason = req.Reason
+	}
+
+	client, err = h.repo.SetTemporaryLimit(r.Context(), clientID, client.Version, limit)
+	if errors.Is(err, store.ErrVersionConflict) {
+		sendUpdateError(w, r, clientID, err)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to set temporary limit", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to set temporary limit")
+		return
+	}
+	if client == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+	h.rl.SetClient(client)
+
+	if limit != nil {
+		slog.Info("Temporary limit set", "client_id", clientID, "capacity", limit.Capacity, "rate_per_sec", limit.RatePerSec, "expires_at", limit.ExpiresAt, "applied_by", limit.AppliedBy, "reason", limit.Reason)
+	} else {
+		slog.Info("Temporary limit cleared", "client_id", clientID, "applied_by", actor(r), "reason", req.Reason)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", clientETag(client))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(client)
+}
+
+// temporaryLimit builds the limit an override asks for, either a multiple of
+// the client's own limits or explicit ones.
+func temporaryLimit(client *models.Client, req *models.TokensRequest, now time.Time) (*models.TemporaryLimit, []problem.InvalidParam) {
+	var invalid []problem.InvalidParam
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration < time.Second || duration > maxOverrideDuration {
+		invalid = append(invalid, problem.Field("duration", "must be a duration between 1s and %s", maxOverrideDuration))
+	}
+
+	limit := &models.TemporaryLimit{ExpiresAt: now.Add(duration), AppliedAt: now}
+	switch {
+	case req.Multiplier != 0:
+		if req.Capacity != 0 || req.RatePerSec != 0 {
+			invalid = append(invalid, problem.Field("multiplier", "must not be combined with capacity or rate_per_sec"))
+			break
+		}
+		if req.Multiplier < 0 {
+			invalid = append(invalid, problem.Field("multiplier", "must be greater than 0"))
+			break
+		}
+		limit.Capacity = max(1, int(math.Round(float64(client.Capacity)*req.Multiplier)))
+		limit.RatePerSec = max(1, int(math.Round(float64(client.RatePerSec)*req.Multiplier)))
+	default:
+		if req.Capacity <= 0 {
+			invalid = append(invalid, problem.Field(models.FieldCapacity, "must be greater than 0"))
+		}
+		if req.RatePerSec <= 0 {
+			invalid = append(invalid, problem.Field(models.FieldRatePerSec, "must be greater than 0"))
+		}
+		limit.Capacity = req.Capacity
+		limit.RatePerSec = req.RatePerSec
+	}
+	return limit, invalid
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+// maxMinuteRange bounds the time range of minute granularity queries.
+const maxMinuteRange = 7 * 24 * time.Hour
+
+type UsageHandler struct {
+	clients store.ClientRepository
+	usage   store.UsageRepository
+}
+
+func NewUsageHandler(clients store.ClientRepository, usage store.UsageRepository) *UsageHandler {
+	return &UsageHandler{clients: clients, usage: usage}
+}
+
+// GetClientUsageHandler returns a client's usage buckets between from and to,
+// as JSON or, with format=csv, as CSV.
+func (h *UsageHandler) GetClientUsageHandler(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("client_id")
+	slog.Debug("Getting client usage", "client_id", clientID)
+
+	granularity, from, to, ok := parseUsageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	client, err := h.clients.GetByID(r.Context(), clientID)
+	if err != nil {
+		slog.Error("Failed to get client", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get client")
+		return
+	}
+	if client == nil {
+		problem.Write(w, r, http.StatusNotFound, fmt.Sprintf("Client with id %s not found", clientID))
+		return
+	}
+
+	usage, err := h.usage.Get(r.Context(), clientID, granularity, from, to)
+	if err != nil {
+		slog.Error("Failed to get client usage", "client_id", clientID, "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get usage")
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(usage)
+	case "csv":
+		writeUsageCSV(w, fmt.Sprintf("usage-%s.csv", clientID), usage)
+	default:
+		problem.Invalid(w, r, problem.Field("format", "must be json or csv"))
+	}
+}
+
+// ExportUsageHandler exports the usage buckets of every client between from
+// and to as CSV, for billing.
+func (h *UsageHandler) ExportUsageHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("Handling usage export request", "method", r.Method, "path", r.URL.Path)
+
+	granularity, from, to, ok := parseUsageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	usage, err := h.usage.Get(r.Context(), "", granularity, from, to)
+	if err != nil {
+		slog.Error("Failed to export usage", "error", err)
+		problem.Write(w, r, http.StatusInternalServerError, "Failed to get usage")
+		return
+	}
+
+	writeUsageCSV(w, "usage.csv", usage)
+}
+
+// parseUsageQuery reads the granularity, hour by default, and the time range,
+// the last 24 hours by default.
+func parseUsageQuery(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, bool) {
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = models.GranularityHour
+	}
+	if granularity != models.GranularityMinute && granularity != models.GranularityHour {
+		problem.Invalid(w, r, problem.Field("granularity", "must be minute or hour"))
+		return "", time.Time{}, time.Time{}, false
+	}
+
+	from, to, ok := parseTimeRange(w, r, 24*time.Hour)
+	if !ok {
+		return "", time.Time{}, time.Time{}, false
+	}
+	if granularity == models.GranularityMinute && to.Sub(from) > maxMinuteRange {
+		problem.Invalid(w, r, problem.Field("from", "must be at most 7 days before to with minute granularity"))
+		return "", time.Time{}, time.Time{}, false
+	}
+	return granularity, from, to, true
+}
+
+func writeUsageCSV(w http.ResponseWriter, filename string, usage []*models.Usage) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"client_id", "granularity", "start", "allowed", "rejected", "bytes_in", "bytes_out",
+		"status_2xx", "status_3xx", "status_4xx", "status_5xx"})
+	for _, u := range usage {
+		cw.Write([]string{
+			u.ClientID, u.Granularity, u.Start.UTC().Format(time.RFC3339),
+			strconv.FormatInt(u.Allowed, 10), strconv.FormatInt(u.Rejected, 10),
+			strconv.FormatInt(u.BytesIn, 10), strconv.FormatInt(u.BytesOut, 10),
+			strconv.FormatInt(u.Status2xx, 10), strconv.FormatInt(u.Status3xx, 10),
+			strconv.FormatInt(u.Status4xx, 10), strconv.FormatInt(u.Status5xx, 10),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.Error("Failed to write usage csv", "error", err)
+	}
+}
@@ -1,15 +1,55 @@
 package handlers
 
 import (
-	"encoding/json"
 	"net/http"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/problem"
 )
 
-func sendError(w http.ResponseWriter, code int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"code":    code,
-		"message": message,
-	})
+// resetOnAlgorithmChange gives the client a full, fresh limiter when its
+// algorithm or window differs from previous, and otherwise only caps its
+// tokens at the new capacity, or at an active temporary one if larger.
+func resetOnAlgorithmChange(client, previous *models.Client) {
+	now := time.Now()
+	if client.Algorithm != previous.Algorithm || client.WindowSeconds != previous.WindowSeconds {
+		client.State = models.LimiterState{}
+		client.Tokens = client.Capacity
+		client.LastRefill = now
+	}
+	capacity := client.Capacity
+	if client.Temporary.Active(now) {
+		capacity = max(capacity, client.Temporary.Capacity)
+	}
+	client.Tokens = min(client.Tokens, capacity)
+}
+
+// parseTimeRange reads the from and to query parameters as RFC 3339 times. A
+// missing to is now and a missing from is span before to. It writes the error
+// response when the range is invalid.
+func parseTimeRange(w http.ResponseWriter, r *http.Request, span time.Duration) (time.Time, time.Time, bool) {
+	to := time.Now()
+	if value := r.URL.Query().Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			problem.Invalid(w, r, problem.Field("to", "must be an RFC 3339 time"))
+			return time.Time{}, time.Time{}, false
+		}
+		to = parsed
+	}
+	from := to.Add(-span)
+	if value := r.URL.Query().Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			problem.Invalid(w, r, problem.Field("from", "must be an RFC 3339 time"))
+			return time.Time{}, time.Time{}, false
+		}
+		from = parsed
+	}
+	if !from.Before(to) {
+		problem.Invalid(w, r, problem.Field("from", "must be before to"))
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
 }
@@ -1,15 +1,22 @@
 package loadbalancer
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/dorik33/cloud/internal/acl"
+	"github.com/dorik33/cloud/internal/ban"
+	"github.com/dorik33/cloud/internal/problem"
 	"github.com/dorik33/cloud/internal/ratelimit"
+	"github.com/dorik33/cloud/internal/usage"
 )
 
 type contextKey string
@@ -17,13 +24,24 @@ type contextKey string
 const (
 	attemptsKey contextKey = "attempts"
 	retryKey    contextKey = "retry"
+	chargeKey   contextKey = "charge"
 )
 
+// charge records what a proxied request was admitted with, so the cost the
+// backend reports can be settled once the response arrives. Shadow requests
+// took no tokens, so nothing is settled or refunded for them.
+type charge struct {
+	clientID string
+	cost     int
+	shadow   bool
+}
+
 type Backend struct {
 	URL          *url.URL
 	Alive        bool
 	mux          sync.RWMutex
 	ReverseProxy *httputil.ReverseProxy
+	ceiling      *ratelimit.Ceiling
 }
 
 func (b *Backend) SetAlive(alive bool) {
@@ -43,20 +61,34 @@ type ServerPool struct {
 	backends       []*Backend
 	currentBackend uint64
 	rl             *ratelimit.RateLimiter
+	acl            *acl.ACL
+	usage          *usage.Recorder
+	jail           *ban.Jail
 }
 
-func NewServerPool(rl *ratelimit.RateLimiter) *ServerPool {
+func NewServerPool(rl *ratelimit.RateLimiter, acl *acl.ACL, usage *usage.Recorder, jail *ban.Jail) *ServerPool {
 	return &ServerPool{
-		rl: rl,
+		rl:    rl,
+		acl:   acl,
+		usage: usage,
+		jail:  jail,
 	}
 }
 
-func (s *ServerPool) AddBackend(url *url.URL) {
+// AddBackend registers a backend. A non-nil ceiling caps the requests per
+// second it is sent; requests are steered to other backends while it is hit.
+func (s *ServerPool) AddBackend(url *url.URL, ceiling *ratelimit.Ceiling) {
 	rp := httputil.NewSingleHostReverseProxy(url)
+	rp.ModifyResponse = s.settleCharge
+	rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Error("Backend request failed", "backend", url, "path", r.URL.Path, "error", err)
+		problem.Write(w, r, http.StatusBadGateway, "Backend request failed")
+	}
 	backend := Backend{
 		URL:          url,
 		Alive:        true,
 		ReverseProxy: rp,
+		ceiling:      ceiling,
 	}
 	s.backends = append(s.backends, &backend)
 }
@@ -65,17 +97,24 @@ func (s *ServerPool) NextIndex() int {
 	return int(atomic.AddUint64(&s.currentBackend, uint64(1)) % uint64(len(s.backends)))
 }
 
+// GetNextBackend returns the next alive backend that is below its ceiling, or
+// nil if there is none.
 func (s *ServerPool) GetNextBackend() *Backend {
 	next := s.NextIndex()
 	l := len(s.backends) + next
 	for i := next; i < l; i++ {
 		idx := i % len(s.backends)
-		if s.backends[idx].IsAlive() {
-			if i != next {
-				atomic.StoreUint64(&s.currentBackend, uint64(idx))
-			}
-			return s.backends[idx]
+		if !s.backends[idx].IsAlive() {
+			continue
 		}
+		if !s.backends[idx].ceiling.Allow() {
+			slog.Debug("Backend at its ceiling, skipping", "backend", s.backends[idx].URL)
+			continue
+		}
+		if i != next {
+			atomic.StoreUint64(&s.currentBackend, uint64(idx))
+		}
+		return s.backends[idx]
 	}
 	return nil
 }
@@ -108,39 +147,193 @@ func (s *ServerPool) StartHealthCheck(interval time.Duration) {
 	}()
 }
 
+// LimitGlobal rejects requests with 503 once the listener exceeds ceiling.
+func LimitGlobal(ceiling *ratelimit.Ceiling, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ceiling.Allow() {
+			slog.Warn("Request rejected by global ceiling", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(ceiling.RetryAfter()), 1)))
+			problem.Write(w, r, http.StatusServiceUnavailable, "Service overloaded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *ServerPool) LoadBalance(w http.ResponseWriter, r *http.Request) {
 	slog.Info("Received request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
 	clientID := r.URL.Query().Get("client_id")
+
+	ip, err := clientIP(r)
+	if err != nil {
+		slog.Error("Failed to parse remote address", "remote", r.RemoteAddr, "error", err)
+		problem.Write(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	if !s.acl.Allowed(ip, r.URL.Path) {
+		slog.Warn("Request rejected by acl", "remote", r.RemoteAddr, "path", r.URL.Path)
+		problem.Write(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+	if clientID != "" && !s.acl.ClientAllowed(ip, clientID) {
+		slog.Warn("Client used from address outside its allowlist", "client_id", clientID, "remote", r.RemoteAddr)
+		problem.Write(w, r, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if until, banned := s.jail.Banned(ban.KindIP, ip.String()); banned {
+		slog.Debug("Request from banned address", "remote", r.RemoteAddr)
+		sendBanned(w, r, until)
+		return
+	}
+	if until, banned := s.jail.Banned(ban.KindClient, clientID); clientID != "" && banned {
+		slog.Debug("Request from banned client", "client_id", clientID)
+		s.usage.Record(clientID, false)
+		sendBanned(w, r, until)
+		return
+	}
+
 	if clientID != "" {
-		allowed, err := s.rl.AllowRequest(r.Context(), clientID)
+		cost := s.rl.Cost(r)
+		decision, err := s.rl.AllowRequest(r.Context(), clientID, cost)
 		if err != nil {
 			slog.Error("Rate limiting error", "client_id", clientID, "error", err)
-			http.Error(w, `{"code": 500, "message": "Internal server error"}`, http.StatusInternalServerError)
+			problem.Write(w, r, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		setRateLimitHeaders(w, decision)
+		if !decision.Allowed && decision.Limit == 0 {
+			// Unknown clients have no usage or limits of their own; guessing
+			// ids counts against the address instead.
+			s.jail.Reject(ban.KindIP, ip.String())
+			slog.Warn("Request rejected for unknown client", "client_id", clientID, "remote", r.RemoteAddr)
+			problem.Write(w, r, http.StatusTooManyRequests, "Too many requests")
 			return
 		}
-		if !allowed {
+		if !decision.Allowed {
+			s.usage.Record(clientID, false)
+			s.jail.Reject(ban.KindClient, clientID)
 			slog.Warn("Request rejected due to rate limit", "client_id", clientID)
-			http.Error(w, `{"code": 429, "message": "Too many requests"}`, http.StatusTooManyRequests)
+			w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(decision.RetryAfter), 1)))
+			problem.Write(w, r, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+
+		quota, err := s.rl.ConsumeQuota(r.Context(), clientID)
+		if err != nil {
+			slog.Error("Quota error", "client_id", clientID, "error", err)
+			problem.Write(w, r, http.StatusInternalServerError, "Internal server error")
 			return
 		}
+		setQuotaHeaders(w, quota)
+		if !quota.Allowed {
+			slog.Warn("Request rejected due to quota", "client_id", clientID, "period", quota.Quota.Period)
+			if !decision.Shadow {
+				s.rl.Charge(r.Context(), clientID, -cost)
+			}
+			s.usage.Record(clientID, false)
+			s.jail.Reject(ban.KindClient, clientID)
+			w.Header().Set("X-Quota-Exceeded", quota.Quota.Period)
+			w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(time.Until(quota.Quota.ResetsAt)), 1)))
+			problem.Write(w, r, http.StatusTooManyRequests, fmt.Sprintf("%s quota exceeded", quotaPeriodName(quota.Quota.Period)))
+			return
+		}
+
+		// The quota is checked before a delayed request waits, so a request
+		// over its quota is not held only to be rejected.
+		decision, err = s.rl.Wait(r.Context(), clientID, cost, decision)
+		if err != nil {
+			slog.Debug("Delayed request cancelled", "client_id", clientID, "error", err)
+			s.rl.RefundQuota(r.Context(), clientID)
+			return
+		}
+		if !decision.Allowed {
+			s.rl.RefundQuota(r.Context(), clientID)
+			setRateLimitHeaders(w, decision)
+			s.usage.Record(clientID, false)
+			s.jail.Reject(ban.KindClient, clientID)
+			slog.Warn("Request rejected due to full delay queue", "client_id", clientID)
+			w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(decision.RetryAfter), 1)))
+			problem.Write(w, r, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), chargeKey, charge{clientID: clientID, cost: cost, shadow: decision.Shadow}))
 	} else {
 		slog.Warn("Request without client_id")
 	}
 	attempts := GetAttemptsFromContext(r)
 	if attempts > 3 {
 		slog.Error("Max attempts reached, terminating", "remote", r.RemoteAddr, "path", r.URL.Path)
-		sendError(w, http.StatusServiceUnavailable, "Service not available")
+		s.unserved(r)
+		problem.Write(w, r, http.StatusServiceUnavailable, "Service not available")
 		return
 	}
 
 	backend := s.GetNextBackend()
 	if backend == nil {
 		slog.Error("No available backends", "remote", r.RemoteAddr, "path", r.URL.Path)
-		sendError(w, http.StatusServiceUnavailable, "Service not available")
+		s.unserved(r)
+		problem.Write(w, r, http.StatusServiceUnavailable, "Service not available")
 		return
 	}
 
 	backendURL := backend.URL.String()
 	slog.Info("Request successfully routed", "backend", backendURL)
-	backend.ReverseProxy.ServeHTTP(w, r)
+	if clientID == "" {
+		backend.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	s.usage.Record(clientID, true)
+	requestPacer, responsePacer := s.rl.Pacers(clientID)
+	body := &pacedReader{ctx: r.Context(), body: r.Body, pacer: requestPacer}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = body
+	}
+	writer := &pacedWriter{ResponseWriter: w, ctx: r.Context(), pacer: responsePacer}
+	backend.ReverseProxy.ServeHTTP(writer, r)
+	s.usage.AddResponse(clientID, writer.status, body.n.Load(), writer.n)
+}
+
+// unserved gives back the tokens and quota an admitted request was charged
+// when it cannot be proxied, and counts it as rejected.
+func (s *ServerPool) unserved(r *http.Request) {
+	c, ok := r.Context().Value(chargeKey).(charge)
+	if !ok {
+		return
+	}
+	if !c.shadow {
+		s.rl.Charge(r.Context(), c.clientID, -c.cost)
+	}
+	s.rl.RefundQuota(r.Context(), c.clientID)
+	s.usage.Record(c.clientID, false)
+}
+
+// settleCharge charges the client the difference between the cost reported
+// by the backend in the cost header and the cost the request was admitted
+// with. The header is not passed on to the caller.
+func (s *ServerPool) settleCharge(resp *http.Response) error {
+	header := s.rl.CostHeader()
+	if header == "" {
+		return nil
+	}
+	reported := resp.Header.Get(header)
+	if reported == "" {
+		return nil
+	}
+	resp.Header.Del(header)
+
+	c, ok := resp.Request.Context().Value(chargeKey).(charge)
+	if !ok || c.shadow {
+		return nil
+	}
+	cost, err := strconv.Atoi(reported)
+	if err != nil || cost < 0 {
+		slog.Warn("Invalid cost reported by backend", "client_id", c.clientID, "cost", reported)
+		return nil
+	}
+
+	s.rl.Charge(resp.Request.Context(), c.clientID, cost-c.cost)
+	return nil
 }
@@ -0,0 +1,83 @@
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/dorik33/cloud/internal/ratelimit"
+)
+
+// pacedReader paces and counts a request body read by the reverse proxy.
+type pacedReader struct {
+	ctx   context.Context
+	body  io.ReadCloser
+	pacer *ratelimit.Pacer
+	n     atomic.Int64
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	if chunk := r.pacer.Chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.body.Read(p)
+	r.n.Add(int64(n))
+	if waitErr := r.pacer.Wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+func (r *pacedReader) Close() error {
+	return r.body.Close()
+}
+
+// pacedWriter paces and counts a response body and remembers its status. It
+// keeps flushing working and exposes the wrapped writer to
+// http.ResponseController.
+type pacedWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	pacer  *ratelimit.Pacer
+	n      int64
+	status int
+}
+
+func (w *pacedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *pacedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), w.pacer.Chunk())]
+		if err := w.pacer.Wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		w.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *pacedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *pacedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -1,12 +1,17 @@
 package loadbalancer
 
 import (
-	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"time"
+
+	"github.com/dorik33/cloud/internal/problem"
+	"github.com/dorik33/cloud/internal/ratelimit"
 )
 
 func isBackendAlive(u *url.URL) bool {
@@ -19,15 +24,58 @@ func isBackendAlive(u *url.URL) bool {
 	return true
 }
 
-func sendError(w http.ResponseWriter, code int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"code":    code,
-		"message": message,
-	}); err != nil {
-		slog.Error("Failed to encode error response", "error", err, "code", code, "message", message)
+func clientIP(r *http.Request) (netip.Addr, error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addrPort.Addr().Unmap(), nil
+}
+
+// setRateLimitHeaders writes the IETF RateLimit headers for a decision. They
+// are omitted for unknown clients, which have no limit to describe.
+func setRateLimitHeaders(w http.ResponseWriter, decision ratelimit.Decision) {
+	if decision.Limit == 0 {
+		return
+	}
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", decision.Limit, ceilSeconds(decision.Window)))
+}
+
+// setQuotaHeaders describes the client's tightest quota, if it has any.
+func setQuotaHeaders(w http.ResponseWriter, decision ratelimit.QuotaDecision) {
+	if decision.Quota == nil {
+		return
 	}
+	h := w.Header()
+	h.Set("X-Quota-Period", decision.Quota.Period)
+	h.Set("X-Quota-Limit", strconv.FormatInt(decision.Quota.Limit, 10))
+	h.Set("X-Quota-Remaining", strconv.FormatInt(max(decision.Quota.Limit-decision.Quota.Used, 0), 10))
+	h.Set("X-Quota-Reset", strconv.Itoa(ceilSeconds(time.Until(decision.Quota.ResetsAt))))
+}
+
+func quotaPeriodName(period string) string {
+	if period == ratelimit.QuotaPeriodDay {
+		return "Daily"
+	}
+	return "Monthly"
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// sendBanned rejects a request of a banned client or address until its ban
+// ends.
+func sendBanned(w http.ResponseWriter, r *http.Request, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(ceilSeconds(time.Until(until)), 1)))
+	problem.Write(w, r, http.StatusTooManyRequests, "Temporarily banned")
 }
 
 func GetAttemptsFromContext(r *http.Request) int {
@@ -2,23 +2,290 @@ package models
 
 import "time"
 
+// Client is a rate limited tenant. Organizations, their clients and the
+// clients' API keys are all clients, linked to the level above by ParentID;
+// a request has to pass the bucket of every level. Zero byte rates leave a
+// client's bandwidth unlimited. Version counts changes to the client's
+// settings; spending tokens does not change it.
 type Client struct {
-	ClientID   string    `json:"client_id"`
+	ClientID            string          `json:"client_id"`
+	ParentID            string          `json:"parent_id,omitempty"`
+	PlanID              string          `json:"plan_id,omitempty"`
+	Overrides           []string        `json:"overrides,omitempty"`
+	Capacity            int             `json:"capacity"`
+	RatePerSec          int             `json:"rate_per_sec"`
+	Algorithm           string          `json:"algorithm"`
+	WindowSeconds       int             `json:"window_seconds"`
+	Shadow              bool            `json:"shadow"`
+	OnLimit             string          `json:"on_limit"`
+	MaxDelayMs          int             `json:"max_delay_ms,omitempty"`
+	MaxQueued           int             `json:"max_queued,omitempty"`
+	RequestBytesPerSec  int             `json:"request_bytes_per_sec"`
+	ResponseBytesPerSec int             `json:"response_bytes_per_sec"`
+	Tokens              int             `json:"tokens"`
+	LastRefill          time.Time       `json:"last_refill"`
+	State               LimiterState    `json:"-"`
+	CreatedAt           time.Time       `json:"created_at"`
+	UpdatedAt           time.Time       `json:"updated_at"`
+	Version             int64           `json:"version"`
+	Temporary           *TemporaryLimit `json:"temporary_limit,omitempty"`
+}
+
+// TemporaryLimit replaces a client's capacity and rate until ExpiresAt, e.g.
+// to let a customer through a traffic spike. AppliedBy is the admin token that
+// set it and Reason the free-form note it was set with.
+type TemporaryLimit struct {
 	Capacity   int       `json:"capacity"`
 	RatePerSec int       `json:"rate_per_sec"`
-	Tokens     int       `json:"tokens"`
-	LastRefill time.Time `json:"last_refill"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	AppliedBy  string    `json:"applied_by"`
+	AppliedAt  time.Time `json:"applied_at"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// Active reports whether the limit is set and not yet expired at now.
+func (t *TemporaryLimit) Active(now time.Time) bool {
+	return t != nil && now.Before(t.ExpiresAt)
+}
+
+// TokensRequest is an administrative change to a client's bucket: reset,
+// add Tokens, drain, or set or clear a temporary limit. A temporary limit is
+// either Multiplier times the client's limits or the given Capacity and
+// RatePerSec, for Duration. Reason is an optional note kept with a temporary
+// limit and logged with the other actions.
+type TokensRequest struct {
+	Action     string  `json:"action"`
+	Tokens     int     `json:"tokens"`
+	Multiplier float64 `json:"multiplier"`
+	Capacity   int     `json:"capacity"`
+	RatePerSec int     `json:"rate_per_sec"`
+	Duration   string  `json:"duration"`
+	Reason     string  `json:"reason"`
+}
+
+// LimiterState holds what the window, GCRA and leaky bucket algorithms need
+// between requests. The token bucket only uses Tokens and LastRefill.
+type LimiterState struct {
+	WindowStart time.Time  `json:"window_start"`
+	Count       int        `json:"count,omitempty"`
+	PrevCount   int        `json:"prev_count,omitempty"`
+	Log         []LogEntry `json:"log,omitempty"`
+	TAT         time.Time  `json:"tat"`
+}
+
+type LogEntry struct {
+	At   time.Time `json:"at"`
+	Cost int       `json:"cost"`
 }
 
 type CreateClient struct {
-	ClientID   string `json:"client_id"`
-	Capacity   int    `json:"capacity"`
-	RatePerSec int    `json:"rate_per_sec"`
+	ClientID            string `json:"client_id"`
+	ParentID            string `json:"parent_id"`
+	PlanID              string `json:"plan_id"`
+	Capacity            int    `json:"capacity"`
+	RatePerSec          int    `json:"rate_per_sec"`
+	Algorithm           string `json:"algorithm"`
+	WindowSeconds       int    `json:"window_seconds"`
+	Shadow              bool   `json:"shadow"`
+	OnLimit             string `json:"on_limit"`
+	MaxDelayMs          int    `json:"max_delay_ms"`
+	MaxQueued           int    `json:"max_queued"`
+	RequestBytesPerSec  int    `json:"request_bytes_per_sec"`
+	ResponseBytesPerSec int    `json:"response_bytes_per_sec"`
 }
 
 type UpdateClient struct {
-	Capacity   int `json:"capacity"`
-	RatePerSec int `json:"rate_per_sec"`
+	ParentID            string `json:"parent_id"`
+	PlanID              string `json:"plan_id"`
+	Capacity            int    `json:"capacity"`
+	RatePerSec          int    `json:"rate_per_sec"`
+	Algorithm           string `json:"algorithm"`
+	WindowSeconds       int    `json:"window_seconds"`
+	Shadow              bool   `json:"shadow"`
+	OnLimit             string `json:"on_limit"`
+	MaxDelayMs          int    `json:"max_delay_ms"`
+	MaxQueued           int    `json:"max_queued"`
+	RequestBytesPerSec  int    `json:"request_bytes_per_sec"`
+	ResponseBytesPerSec int    `json:"response_bytes_per_sec"`
+}
+
+// ClientQuery selects a page of clients. Zero fields do not filter. Throttled
+// selects clients that could or could not take Cost tokens now. Sort is
+// client_id, created_at or updated_at, the time of the last settings change;
+// Cursor continues a previous page and must be used with the same filters and
+// sort.
+type ClientQuery struct {
+	Limit       int
+	Cursor      string
+	Prefix      string
+	PlanID      string
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Throttled   *bool
+	Cost        int
+	Sort        string
+	Desc        bool
+}
+
+type ClientPage struct {
+	Clients    []*Client `json:"clients"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// MaxChainDepth bounds how many levels, the client itself included, are
+// followed up the parent chain.
+const MaxChainDepth = 8
+
+// Client fields that can be inherited from a plan. A client lists the ones it
+// sets itself in Overrides.
+const (
+	FieldCapacity      = "capacity"
+	FieldRatePerSec    = "rate_per_sec"
+	FieldAlgorithm     = "algorithm"
+	FieldWindowSeconds = "window_seconds"
+)
+
+type Plan struct {
+	PlanID        string    `json:"plan_id"`
+	Capacity      int       `json:"capacity"`
+	RatePerSec    int       `json:"rate_per_sec"`
+	Algorithm     string    `json:"algorithm"`
+	WindowSeconds int       `json:"window_seconds"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type CreatePlan struct {
+	PlanID        string `json:"plan_id"`
+	Capacity      int    `json:"capacity"`
+	RatePerSec    int    `json:"rate_per_sec"`
+	Algorithm     string `json:"algorithm"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+type UpdatePlan struct {
+	Capacity      int    `json:"capacity"`
+	RatePerSec    int    `json:"rate_per_sec"`
+	Algorithm     string `json:"algorithm"`
+	WindowSeconds int    `json:"window_seconds"`
+}
+
+// Quota caps the number of requests a client may make per calendar day or
+// month in Timezone. Used counts requests since PeriodStart.
+type Quota struct {
+	ClientID    string    `json:"client_id"`
+	Period      string    `json:"period"`
+	Limit       int64     `json:"limit"`
+	Timezone    string    `json:"timezone"`
+	Used        int64     `json:"used"`
+	PeriodStart time.Time `json:"period_start"`
+	ResetsAt    time.Time `json:"resets_at"`
+}
+
+type SetQuota struct {
+	Limit    int64  `json:"limit"`
+	Timezone string `json:"timezone"`
+}
+
+type ClientWithQuotas struct {
+	*Client
+	Quotas []*Quota `json:"quotas"`
+}
+
+type ACLRule struct {
+	ID        int64     `json:"id"`
+	Action    string    `json:"action"`
+	CIDR      string    `json:"cidr"`
+	Route     string    `json:"route,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateACLRule struct {
+	Action   string `json:"action"`
+	CIDR     string `json:"cidr"`
+	Route    string `json:"route"`
+	ClientID string `json:"client_id"`
+}
+
+// AdminToken grants access to the management API with the permissions of
+// its role. Only a hash of the secret is stored, so Token is set only in the
+// response that creates the token.
+type AdminToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type CreateAdminToken struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type UpdateAdminToken struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// ShadowDenial counts the requests of a client in one minute that its limit
+// would have rejected had shadow mode been off.
+type ShadowDenial struct {
+	ClientID string    `json:"client_id"`
+	Minute   time.Time `json:"minute"`
+	Denials  int64     `json:"denials"`
+}
+
+// ShadowReport sums a client's shadow denials over a time window.
+type ShadowReport struct {
+	ClientID  string    `json:"client_id"`
+	Denials   int64     `json:"denials"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Usage counts what a client did in one minute or hour starting at Start:
+// requests let through and rejected by its limits, body bytes sent and
+// received, and backend responses by status class.
+type Usage struct {
+	ClientID    string    `json:"client_id"`
+	Granularity string    `json:"granularity"`
+	Start       time.Time `json:"start"`
+	Allowed     int64     `json:"allowed"`
+	Rejected    int64     `json:"rejected"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Status2xx   int64     `json:"status_2xx"`
+	Status3xx   int64     `json:"status_3xx"`
+	Status4xx   int64     `json:"status_4xx"`
+	Status5xx   int64     `json:"status_5xx"`
+}
+
+// Usage bucket sizes.
+const (
+	GranularityMinute = "minute"
+	GranularityHour   = "hour"
+)
+
+// Ban keeps a client or address that kept exceeding its limits out until
+// Until. Offences counts its bans, which grow longer on every repeat.
+type Ban struct {
+	Kind     string    `json:"kind"`
+	Subject  string    `json:"subject"`
+	Until    time.Time `json:"banned_until"`
+	Offences int       `json:"offences"`
+}
+
+// IdempotentResponse is what was answered to the first request carrying an
+// idempotency key. A zero Status means that request is still being handled.
+type IdempotentResponse struct {
+	Key         string
+	RequestHash string
+	Status      int
+	Headers     map[string]string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
 }
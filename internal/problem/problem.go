@@ -0,0 +1,114 @@
+// Package problem writes error responses as RFC 7807 problem details.
+package problem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	ContentType     = "application/problem+json"
+	RequestIDHeader = "X-Request-ID"
+)
+
+// Problem is the body of an error response. Type is about:blank unless the
+// problem has a more specific meaning than its status.
+type Problem struct {
+	Type          string         `json:"type"`
+	Title         string         `json:"title"`
+	Status        int            `json:"status"`
+	Detail        string         `json:"detail,omitempty"`
+	Instance      string         `json:"instance,omitempty"`
+	RequestID     string         `json:"request_id,omitempty"`
+	InvalidParams []InvalidParam `json:"invalid_params,omitempty"`
+}
+
+// InvalidParam names a request field or query parameter that failed
+// validation and why. It is also an error, so that validation helpers can
+// return it.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (p InvalidParam) Error() string {
+	return p.Name + " " + p.Reason
+}
+
+// Field returns an InvalidParam whose reason is formatted from format and args.
+func Field(name, format string, args ...any) InvalidParam {
+	return InvalidParam{Name: name, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Write sends a problem with the given status and detail.
+func Write(w http.ResponseWriter, r *http.Request, status int, detail string, invalid ...InvalidParam) {
+	p := &Problem{
+		Type:          "about:blank",
+		Title:         http.StatusText(status),
+		Status:        status,
+		Detail:        detail,
+		Instance:      r.URL.Path,
+		RequestID:     RequestID(r.Context()),
+		InvalidParams: invalid,
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		slog.Error("Failed to encode error response", "error", err, "status", status, "detail", detail)
+	}
+}
+
+// Invalid rejects a request with 400 Bad Request listing its invalid fields.
+func Invalid(w http.ResponseWriter, r *http.Request, invalid ...InvalidParam) {
+	detail := "Request has invalid fields"
+	if len(invalid) == 1 {
+		detail = invalid[0].Error()
+	}
+	Write(w, r, http.StatusBadRequest, detail, invalid...)
+}
+
+// BadRequest rejects a request with 400 Bad Request for err, listing the
+// field at fault when err is an InvalidParam.
+func BadRequest(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid InvalidParam
+	if errors.As(err, &invalid) {
+		Invalid(w, r, invalid)
+		return
+	}
+	Write(w, r, http.StatusBadRequest, err.Error())
+}
+
+type requestIDKey struct{}
+
+// WithRequestID gives every request an ID, taken from its X-Request-ID header
+// or generated. The ID is echoed in the response, passed on to backends and
+// included in problems.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID WithRequestID gave the request, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,419 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+const (
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmLeakyBucket   = "leaky_bucket"
+)
+
+// Decision is the outcome of taking tokens from a client. Reset is the time
+// until the limit is fully available again and RetryAfter, on rejection, the
+// time until the same cost would be allowed. Delay is set by shaping
+// algorithms when an allowed request has to wait for its slot. Shadow marks a
+// request that was let through only because shadow mode is on.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Window     time.Duration
+	Reset      time.Duration
+	RetryAfter time.Duration
+	Delay      time.Duration
+	Shadow     bool
+
+	// queue and maxQueued bound the delayed requests of a client in delay
+	// mode while they wait.
+	queue     bool
+	maxQueued int
+}
+
+// Algorithm enforces a client's limit using Capacity, RatePerSec and
+// WindowSeconds as its parameters and Tokens, LastRefill and State as its
+// stored state. When Take rejects, whatever it changed must be safe to
+// discard. Adjust credits (positive) or charges (negative) tokens without a
+// check.
+type Algorithm interface {
+	Take(client *models.Client, cost int, now time.Time) Decision
+	Adjust(client *models.Client, tokens int, now time.Time)
+}
+
+// Reserver is implemented by algorithms that can admit a request ahead of
+// time: when the limit is reached but the tokens it needs will be available
+// within maxDelay, Reserve takes them in advance and returns an allowed
+// decision whose Delay is the time left until then.
+type Reserver interface {
+	Reserve(client *models.Client, cost int, now time.Time, maxDelay time.Duration) Decision
+}
+
+var algorithms = map[string]Algorithm{
+	AlgorithmTokenBucket:   tokenBucket{},
+	AlgorithmFixedWindow:   fixedWindow{},
+	AlgorithmSlidingWindow: slidingWindow{},
+	AlgorithmSlidingLog:    slidingLog{},
+	AlgorithmGCRA:          gcra{},
+	AlgorithmLeakyBucket:   leakyBucket{},
+}
+
+func ValidAlgorithm(name string) bool {
+	_, ok := algorithms[name]
+	return ok
+}
+
+func algorithmFor(client *models.Client) Algorithm {
+	if algorithm, ok := algorithms[client.Algorithm]; ok {
+		return algorithm
+	}
+	return tokenBucket{}
+}
+
+// tokenBucket allows bursts of Capacity tokens refilled at RatePerSec.
+type tokenBucket struct{}
+
+func (tokenBucket) Take(client *models.Client, cost int, now time.Time) Decision {
+	refill(client, now)
+	allowed := client.Tokens >= cost
+	if allowed {
+		client.Tokens -= cost
+	}
+	return tokenBucketDecision(client, allowed, cost, now)
+}
+
+// Reserve leaves the bucket in debt by the tokens it lacks; later requests
+// wait behind it until refills have paid the debt back.
+func (b tokenBucket) Reserve(client *models.Client, cost int, now time.Time, maxDelay time.Duration) Decision {
+	decision := b.Take(client, cost, now)
+	if decision.Allowed {
+		return decision
+	}
+	if decision.RetryAfter > maxDelay {
+		decision.RetryAfter -= maxDelay
+		return decision
+	}
+	client.Tokens -= cost
+	reserved := tokenBucketDecision(client, true, cost, now)
+	reserved.Delay = decision.RetryAfter
+	return reserved
+}
+
+// tokenBucketDecision derives the timing of a decision from the bucket state
+// left after it. LastRefill carries the partial progress towards the next
+// token, so both times are measured from it.
+func tokenBucketDecision(client *models.Client, allowed bool, cost int, now time.Time) Decision {
+	rate := max(client.RatePerSec, 1)
+	untilTokens := func(n int) time.Duration {
+		if n <= 0 {
+			return 0
+		}
+		return max(client.LastRefill.Add(time.Duration(n)*time.Second/time.Duration(rate)).Sub(now), 0)
+	}
+
+	decision := Decision{
+		Allowed:   allowed,
+		Remaining: max(client.Tokens, 0),
+		Window:    time.Duration(client.Capacity) * time.Second / time.Duration(rate),
+		Reset:     untilTokens(client.Capacity - client.Tokens),
+	}
+	if !allowed {
+		decision.RetryAfter = untilTokens(cost - client.Tokens)
+	}
+	return decision
+}
+
+func (tokenBucket) Adjust(client *models.Client, tokens int, now time.Time) {
+	refill(client, now)
+	client.Tokens = min(max(client.Tokens+tokens, min(client.Tokens, 0)), client.Capacity)
+}
+
+// refill credits the tokens earned since LastRefill at RatePerSec, capped at
+// Capacity. LastRefill only moves forward by the time that was converted into
+// whole tokens, so partial progress carries over to the next request.
+func refill(client *models.Client, now time.Time) {
+	if client.RatePerSec <= 0 || !now.After(client.LastRefill) {
+		return
+	}
+
+	earned := now.Sub(client.LastRefill).Seconds() * float64(client.RatePerSec)
+	if float64(client.Tokens)+earned >= float64(client.Capacity) {
+		client.Tokens = client.Capacity
+		client.LastRefill = now
+		return
+	}
+
+	tokens := int(earned)
+	if tokens == 0 {
+		return
+	}
+	client.Tokens += tokens
+	client.LastRefill = client.LastRefill.Add(time.Duration(tokens) * time.Second / time.Duration(client.RatePerSec))
+}
+
+// fixedWindow allows Capacity tokens per WindowSeconds, with windows aligned
+// to multiples of the window length.
+type fixedWindow struct{}
+
+func (fixedWindow) Take(client *models.Client, cost int, now time.Time) Decision {
+	rotateWindow(client, now, false)
+	reset := client.State.WindowStart.Add(windowOf(client)).Sub(now)
+	if client.State.Count+cost > client.Capacity {
+		return Decision{
+			Remaining:  max(client.Capacity-client.State.Count, 0),
+			Window:     windowOf(client),
+			Reset:      reset,
+			RetryAfter: reset,
+		}
+	}
+	client.State.Count += cost
+	client.Tokens = client.Capacity - client.State.Count
+	return Decision{Allowed: true, Remaining: client.Tokens, Window: windowOf(client), Reset: reset}
+}
+
+func (fixedWindow) Adjust(client *models.Client, tokens int, now time.Time) {
+	rotateWindow(client, now, false)
+	client.State.Count = max(client.State.Count-tokens, 0)
+	client.Tokens = max(client.Capacity-client.State.Count, 0)
+}
+
+// slidingWindow approximates a rolling window by weighting the previous
+// fixed window's count by how much of it still overlaps the rolling one.
+type slidingWindow struct{}
+
+func (slidingWindow) Take(client *models.Client, cost int, now time.Time) Decision {
+	rotateWindow(client, now, true)
+	window := windowOf(client)
+	end := client.State.WindowStart.Add(window)
+	used := slidingCount(client, now)
+	if used+cost > client.Capacity {
+		return Decision{
+			Remaining:  max(client.Capacity-used, 0),
+			Window:     window,
+			Reset:      end.Add(window).Sub(now),
+			RetryAfter: slidingRetryAfter(client, cost, now),
+		}
+	}
+	client.State.Count += cost
+	client.Tokens = client.Capacity - used - cost
+	return Decision{Allowed: true, Remaining: client.Tokens, Window: window, Reset: end.Add(window).Sub(now)}
+}
+
+// slidingRetryAfter finds when the weighted count leaves room for cost: either
+// later in the current window, as the previous window's weight decays, or in
+// the next one, where the current count becomes the decaying part.
+func slidingRetryAfter(client *models.Client, cost int, now time.Time) time.Duration {
+	window := windowOf(client)
+	free := float64(client.Capacity - cost)
+	if free < 0 {
+		return 0
+	}
+
+	count, prev := float64(client.State.Count), float64(client.State.PrevCount)
+	start := client.State.WindowStart
+	if count <= free && prev > 0 {
+		at := start.Add(time.Duration(float64(window) * (1 - (free-count)/prev)))
+		return max(at.Sub(now), 0)
+	}
+	if count > 0 {
+		at := start.Add(window).Add(time.Duration(float64(window) * (1 - free/count)))
+		return max(at.Sub(now), 0)
+	}
+	return 0
+}
+
+func (slidingWindow) Adjust(client *models.Client, tokens int, now time.Time) {
+	rotateWindow(client, now, true)
+	client.State.Count = max(client.State.Count-tokens, 0)
+	client.Tokens = max(client.Capacity-slidingCount(client, now), 0)
+}
+
+func slidingCount(client *models.Client, now time.Time) int {
+	window := windowOf(client)
+	overlap := 1 - float64(now.Sub(client.State.WindowStart))/float64(window)
+	return client.State.Count + int(math.Ceil(float64(client.State.PrevCount)*overlap))
+}
+
+func rotateWindow(client *models.Client, now time.Time, keepPrevious bool) {
+	window := windowOf(client)
+	start := now.Truncate(window)
+	if client.State.WindowStart.Equal(start) {
+		return
+	}
+	if keepPrevious && client.State.WindowStart.Equal(start.Add(-window)) {
+		client.State.PrevCount = client.State.Count
+	} else {
+		client.State.PrevCount = 0
+	}
+	client.State.Count = 0
+	client.State.WindowStart = start
+}
+
+// slidingLog keeps a timestamped entry per request and allows Capacity
+// tokens in any WindowSeconds long period. It is exact but stores up to
+// Capacity entries per client.
+type slidingLog struct{}
+
+func (slidingLog) Take(client *models.Client, cost int, now time.Time) Decision {
+	used := trimLog(client, now)
+	window := windowOf(client)
+	if used+cost > client.Capacity {
+		decision := Decision{Remaining: max(client.Capacity-used, 0), Window: window}
+		for _, entry := range client.State.Log {
+			used -= entry.Cost
+			if used+cost <= client.Capacity && decision.RetryAfter == 0 {
+				decision.RetryAfter = entry.At.Add(window).Sub(now)
+			}
+		}
+		if last := len(client.State.Log); last > 0 {
+			decision.Reset = client.State.Log[last-1].At.Add(window).Sub(now)
+		}
+		return decision
+	}
+	client.State.Log = append(client.State.Log, models.LogEntry{At: now, Cost: cost})
+	client.Tokens = client.Capacity - used - cost
+	return Decision{Allowed: true, Remaining: client.Tokens, Window: window, Reset: window}
+}
+
+func (slidingLog) Adjust(client *models.Client, tokens int, now time.Time) {
+	trimLog(client, now)
+	if tokens < 0 {
+		client.State.Log = append(client.State.Log, models.LogEntry{At: now, Cost: -tokens})
+	}
+	for tokens > 0 && len(client.State.Log) > 0 {
+		last := &client.State.Log[len(client.State.Log)-1]
+		taken := min(last.Cost, tokens)
+		last.Cost -= taken
+		tokens -= taken
+		if last.Cost == 0 {
+			client.State.Log = client.State.Log[:len(client.State.Log)-1]
+		}
+	}
+	client.Tokens = max(client.Capacity-trimLog(client, now), 0)
+}
+
+// trimLog drops entries that left the window and returns the tokens used by
+// the remaining ones.
+func trimLog(client *models.Client, now time.Time) int {
+	cutoff := now.Add(-windowOf(client))
+	log := client.State.Log
+	for len(log) > 0 && !log[0].At.After(cutoff) {
+		log = log[1:]
+	}
+	client.State.Log = log
+
+	used := 0
+	for _, entry := range log {
+		used += entry.Cost
+	}
+	return used
+}
+
+// gcra is the generic cell rate algorithm: tokens are emitted every
+// 1/RatePerSec seconds and up to Capacity of them may be taken ahead of time.
+// It behaves like a token bucket but keeps a single timestamp as state.
+type gcra struct{}
+
+func (gcra) Take(client *models.Client, cost int, now time.Time) Decision {
+	interval, tolerance := emission(client)
+	tat := laterOf(client.State.TAT, now)
+	next := tat.Add(time.Duration(cost) * interval)
+	if next.Sub(now) > tolerance {
+		return Decision{
+			Remaining:  remainingBefore(tat, now, interval, tolerance),
+			Window:     tolerance,
+			Reset:      tat.Sub(now),
+			RetryAfter: next.Sub(now) - tolerance,
+		}
+	}
+	client.State.TAT = next
+	client.Tokens = remainingBefore(next, now, interval, tolerance)
+	return Decision{Allowed: true, Remaining: client.Tokens, Window: tolerance, Reset: next.Sub(now)}
+}
+
+// Reserve pushes the theoretical arrival time past the tolerance, so the
+// request waits for its emission slot.
+func (g gcra) Reserve(client *models.Client, cost int, now time.Time, maxDelay time.Duration) Decision {
+	decision := g.Take(client, cost, now)
+	if decision.Allowed {
+		return decision
+	}
+	if decision.RetryAfter > maxDelay {
+		decision.RetryAfter -= maxDelay
+		return decision
+	}
+	interval, tolerance := emission(client)
+	next := laterOf(client.State.TAT, now).Add(time.Duration(cost) * interval)
+	client.State.TAT = next
+	client.Tokens = 0
+	return Decision{Allowed: true, Window: tolerance, Reset: next.Sub(now), Delay: decision.RetryAfter}
+}
+
+func (gcra) Adjust(client *models.Client, tokens int, now time.Time) {
+	shiftTAT(client, tokens, now)
+}
+
+// leakyBucket queues up to Capacity tokens and lets them through at
+// RatePerSec. Instead of passing a burst immediately it delays each request
+// until its slot, smoothing traffic to the backends.
+type leakyBucket struct{}
+
+func (leakyBucket) Take(client *models.Client, cost int, now time.Time) Decision {
+	interval, tolerance := emission(client)
+	tat := laterOf(client.State.TAT, now)
+	next := tat.Add(time.Duration(cost) * interval)
+	if next.Sub(now) > tolerance {
+		return Decision{
+			Remaining:  remainingBefore(tat, now, interval, tolerance),
+			Window:     tolerance,
+			Reset:      tat.Sub(now),
+			RetryAfter: next.Sub(now) - tolerance,
+		}
+	}
+	client.State.TAT = next
+	client.Tokens = remainingBefore(next, now, interval, tolerance)
+	return Decision{
+		Allowed:   true,
+		Remaining: client.Tokens,
+		Window:    tolerance,
+		Reset:     next.Sub(now),
+		Delay:     tat.Sub(now),
+	}
+}
+
+func (leakyBucket) Adjust(client *models.Client, tokens int, now time.Time) {
+	shiftTAT(client, tokens, now)
+}
+
+func emission(client *models.Client) (interval, tolerance time.Duration) {
+	interval = time.Second / time.Duration(max(client.RatePerSec, 1))
+	return interval, time.Duration(client.Capacity) * interval
+}
+
+func shiftTAT(client *models.Client, tokens int, now time.Time) {
+	interval, tolerance := emission(client)
+	tat := laterOf(client.State.TAT, now).Add(-time.Duration(tokens) * interval)
+	client.State.TAT = laterOf(tat, now)
+	client.Tokens = remainingBefore(client.State.TAT, now, interval, tolerance)
+}
+
+func remainingBefore(tat, now time.Time, interval, tolerance time.Duration) int {
+	return max(int((tolerance-tat.Sub(now))/interval), 0)
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func windowOf(client *models.Client) time.Duration {
+	return time.Duration(max(client.WindowSeconds, 1)) * time.Second
+}
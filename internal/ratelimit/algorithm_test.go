@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// base is aligned to every window length used below.
+var base = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type step struct {
+	at         time.Duration
+	cost       int
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+	delay      time.Duration
+}
+
+func newTestClient(algorithm string, capacity, rate, window int) *models.Client {
+	return &models.Client{
+		ClientID:      "test",
+		Algorithm:     algorithm,
+		Capacity:      capacity,
+		RatePerSec:    rate,
+		WindowSeconds: window,
+		Tokens:        capacity,
+		LastRefill:    base,
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		capacity  int
+		rate      int
+		window    int
+		steps     []step
+	}{
+		{
+			algorithm: AlgorithmTokenBucket, capacity: 3, rate: 1,
+			steps: []step{
+				{at: 0, cost: 2, allowed: true, remaining: 1},
+				{at: 0, cost: 1, allowed: true, remaining: 0},
+				{at: 0, cost: 1, remaining: 0, retryAfter: time.Second},
+				{at: time.Second, cost: 1, allowed: true, remaining: 0},
+				{at: 1500 * time.Millisecond, cost: 1, remaining: 0, retryAfter: 500 * time.Millisecond},
+				{at: 2 * time.Second, cost: 2, remaining: 1, retryAfter: time.Second},
+				{at: 10 * time.Second, cost: 3, allowed: true, remaining: 0},
+			},
+		},
+		{
+			algorithm: AlgorithmFixedWindow, capacity: 2, window: 10,
+			steps: []step{
+				{at: 0, cost: 1, allowed: true, remaining: 1},
+				{at: 5 * time.Second, cost: 1, allowed: true, remaining: 0},
+				{at: 9 * time.Second, cost: 1, remaining: 0, retryAfter: time.Second},
+				{at: 10 * time.Second, cost: 2, allowed: true, remaining: 0},
+			},
+		},
+		{
+			algorithm: AlgorithmSlidingWindow, capacity: 4, window: 10,
+			steps: []step{
+				{at: 0, cost: 4, allowed: true, remaining: 0},
+				{at: 10 * time.Second, cost: 1, remaining: 0, retryAfter: 2500 * time.Millisecond},
+				{at: 15 * time.Second, cost: 2, allowed: true, remaining: 0},
+				{at: 15 * time.Second, cost: 1, remaining: 0, retryAfter: 2500 * time.Millisecond},
+			},
+		},
+		{
+			algorithm: AlgorithmSlidingLog, capacity: 2, window: 10,
+			steps: []step{
+				{at: 0, cost: 1, allowed: true, remaining: 1},
+				{at: 4 * time.Second, cost: 1, allowed: true, remaining: 0},
+				{at: 6 * time.Second, cost: 1, remaining: 0, retryAfter: 4 * time.Second},
+				{at: 10 * time.Second, cost: 1, allowed: true, remaining: 0},
+				{at: 11 * time.Second, cost: 1, remaining: 0, retryAfter: 3 * time.Second},
+			},
+		},
+		{
+			algorithm: AlgorithmGCRA, capacity: 2, rate: 1,
+			steps: []step{
+				{at: 0, cost: 1, allowed: true, remaining: 1},
+				{at: 0, cost: 1, allowed: true, remaining: 0},
+				{at: 0, cost: 1, remaining: 0, retryAfter: time.Second},
+				{at: time.Second, cost: 1, allowed: true, remaining: 0},
+				{at: 5 * time.Second, cost: 2, allowed: true, remaining: 0},
+			},
+		},
+		{
+			algorithm: AlgorithmLeakyBucket, capacity: 2, rate: 1,
+			steps: []step{
+				{at: 0, cost: 1, allowed: true, remaining: 1},
+				{at: 0, cost: 1, allowed: true, remaining: 0, delay: time.Second},
+				{at: 0, cost: 1, remaining: 0, retryAfter: time.Second},
+				{at: 1500 * time.Millisecond, cost: 1, allowed: true, remaining: 0, delay: 500 * time.Millisecond},
+			},
+		},
+	}
+	for _, tt := range tests {
+		client := newTestClient(tt.algorithm, tt.capacity, tt.rate, tt.window)
+		algorithm := algorithmFor(client)
+		for i, s := range tt.steps {
+			d := algorithm.Take(client, s.cost, base.Add(s.at))
+			if d.Allowed != s.allowed || d.Remaining != s.remaining || d.RetryAfter != s.retryAfter || d.Delay != s.delay {
+				t.Errorf("%s step %d: got allowed=%v remaining=%d retry_after=%s delay=%s, want allowed=%v remaining=%d retry_after=%s delay=%s",
+					tt.algorithm, i, d.Allowed, d.Remaining, d.RetryAfter, d.Delay, s.allowed, s.remaining, s.retryAfter, s.delay)
+			}
+		}
+	}
+}
+
+func TestRefill(t *testing.T) {
+	tests := []struct {
+		name           string
+		tokens         int
+		elapsed        time.Duration
+		wantTokens     int
+		wantLastRefill time.Duration
+	}{
+		{name: "nothing earned", tokens: 0, elapsed: 400 * time.Millisecond, wantTokens: 0, wantLastRefill: 0},
+		{name: "partial progress carries over", tokens: 0, elapsed: 1750 * time.Millisecond, wantTokens: 3, wantLastRefill: 1500 * time.Millisecond},
+		{name: "capped at capacity", tokens: 8, elapsed: time.Minute, wantTokens: 10, wantLastRefill: time.Minute},
+		{name: "clock going back", tokens: 3, elapsed: -time.Second, wantTokens: 3, wantLastRefill: 0},
+	}
+	for _, tt := range tests {
+		client := newTestClient(AlgorithmTokenBucket, 10, 2, 0)
+		client.Tokens = tt.tokens
+		refill(client, base.Add(tt.elapsed))
+		if client.Tokens != tt.wantTokens || !client.LastRefill.Equal(base.Add(tt.wantLastRefill)) {
+			t.Errorf("%s: tokens=%d last_refill=+%s, want tokens=%d last_refill=+%s",
+				tt.name, client.Tokens, client.LastRefill.Sub(base), tt.wantTokens, tt.wantLastRefill)
+		}
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		take      int
+		adjust    int
+		want      int
+	}{
+		{algorithm: AlgorithmTokenBucket, take: 3, adjust: 2, want: 4},
+		{algorithm: AlgorithmTokenBucket, take: 1, adjust: 5, want: 5},
+		{algorithm: AlgorithmTokenBucket, take: 1, adjust: -10, want: 0},
+		{algorithm: AlgorithmFixedWindow, take: 3, adjust: 2, want: 4},
+		{algorithm: AlgorithmFixedWindow, take: 1, adjust: -2, want: 2},
+		{algorithm: AlgorithmSlidingWindow, take: 3, adjust: 2, want: 4},
+		{algorithm: AlgorithmSlidingLog, take: 3, adjust: 2, want: 4},
+		{algorithm: AlgorithmSlidingLog, take: 1, adjust: -2, want: 2},
+		{algorithm: AlgorithmGCRA, take: 3, adjust: 2, want: 4},
+		{algorithm: AlgorithmLeakyBucket, take: 3, adjust: -1, want: 1},
+	}
+	for _, tt := range tests {
+		client := newTestClient(tt.algorithm, 5, 1, 10)
+		algorithm := algorithmFor(client)
+		if d := algorithm.Take(client, tt.take, base); !d.Allowed {
+			t.Fatalf("%s: take %d rejected", tt.algorithm, tt.take)
+		}
+		algorithm.Adjust(client, tt.adjust, base)
+		if client.Tokens != tt.want {
+			t.Errorf("%s: take %d, adjust %d: tokens = %d, want %d", tt.algorithm, tt.take, tt.adjust, client.Tokens, tt.want)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmTokenBucket, AlgorithmGCRA} {
+		client := newTestClient(algorithm, 1, 1, 0)
+		reserver := algorithmFor(client).(Reserver)
+
+		if d := reserver.Reserve(client, 1, base, 2*time.Second); !d.Allowed || d.Delay != 0 {
+			t.Errorf("%s: first request: allowed=%v delay=%s, want allowed without delay", algorithm, d.Allowed, d.Delay)
+		}
+		if d := reserver.Reserve(client, 1, base, 2*time.Second); !d.Allowed || d.Delay != time.Second {
+			t.Errorf("%s: second request: allowed=%v delay=%s, want allowed after 1s", algorithm, d.Allowed, d.Delay)
+		}
+		if d := reserver.Reserve(client, 1, base, 1500*time.Millisecond); d.Allowed || d.RetryAfter != 500*time.Millisecond {
+			t.Errorf("%s: third request: allowed=%v retry_after=%s, want rejected for 500ms", algorithm, d.Allowed, d.RetryAfter)
+		}
+	}
+}
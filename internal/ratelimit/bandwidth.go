@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// maxChunk bounds how many bytes a paced transfer moves between waits.
+const maxChunk = 32 << 10
+
+// Pacer spreads a byte stream over time at a fixed number of bytes per second,
+// allowing a burst of one second worth of bytes. All transfers of a client
+// share its pacers, so the rate holds across concurrent requests. A nil Pacer
+// does not limit anything.
+type Pacer struct {
+	mux  sync.Mutex
+	rate int
+	next time.Time
+}
+
+// Wait blocks until n more bytes fit the rate, or ctx is done.
+func (p *Pacer) Wait(ctx context.Context, n int) error {
+	if p == nil || n <= 0 {
+		return nil
+	}
+	p.mux.Lock()
+	now := time.Now()
+	p.next = laterOf(p.next, now.Add(-time.Second)).Add(time.Duration(n) * time.Second / time.Duration(p.rate))
+	wait := p.next.Sub(now)
+	p.mux.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Chunk is the largest number of bytes to move before calling Wait, so a
+// single large read or write is spread out rather than sent at once.
+func (p *Pacer) Chunk() int {
+	if p == nil {
+		return maxChunk
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return min(max(p.rate, 1), maxChunk)
+}
+
+func (p *Pacer) setRate(rate int) {
+	p.mux.Lock()
+	p.rate = rate
+	p.mux.Unlock()
+}
+
+type clientPacers struct {
+	request  *Pacer
+	response *Pacer
+}
+
+// Pacers returns the pacers of a client's request and response bodies. They
+// are nil when the client has no bandwidth limit in that direction.
+func (rl *RateLimiter) Pacers(clientID string) (request, response *Pacer) {
+	rl.pacersMux.Lock()
+	defer rl.pacersMux.Unlock()
+
+	pacers, ok := rl.pacers[clientID]
+	if !ok {
+		return nil, nil
+	}
+	return pacers.request, pacers.response
+}
+
+// setPacers creates, updates or drops the pacers of a client to match its
+// byte rates. Transfers in progress keep their pacer and pick up a new rate.
+func (rl *RateLimiter) setPacers(client *models.Client) {
+	rl.pacersMux.Lock()
+	defer rl.pacersMux.Unlock()
+
+	pacers, ok := rl.pacers[client.ClientID]
+	if !ok {
+		pacers = &clientPacers{}
+	}
+	pacers.request = pacerFor(pacers.request, client.RequestBytesPerSec)
+	pacers.response = pacerFor(pacers.response, client.ResponseBytesPerSec)
+	if pacers.request == nil && pacers.response == nil {
+		delete(rl.pacers, client.ClientID)
+		return
+	}
+	rl.pacers[client.ClientID] = pacers
+}
+
+func (rl *RateLimiter) removePacers(clientID string) {
+	rl.pacersMux.Lock()
+	delete(rl.pacers, clientID)
+	rl.pacersMux.Unlock()
+}
+
+func pacerFor(current *Pacer, rate int) *Pacer {
+	if rate <= 0 {
+		return nil
+	}
+	if current == nil {
+		return &Pacer{rate: rate}
+	}
+	current.setRate(rate)
+	return current
+}
@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/config"
+)
+
+// Ceiling is an in-process token bucket guarding a shared resource, such as
+// the listener or a backend, regardless of which client a request belongs to.
+// A nil Ceiling allows everything.
+type Ceiling struct {
+	rps   float64
+	burst float64
+
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewCeiling returns a ceiling of cfg.RPS requests per second with bursts of
+// cfg.Burst, or nil when cfg.RPS is not positive. The burst defaults to one
+// second worth of requests.
+func NewCeiling(cfg config.CeilingConfig) *Ceiling {
+	if cfg.RPS <= 0 {
+		return nil
+	}
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = max(cfg.RPS, 1)
+	}
+	return &Ceiling{rps: cfg.RPS, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Allow takes a token if one is available.
+func (c *Ceiling) Allow() bool {
+	if c == nil {
+		return true
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	now := time.Now()
+	c.tokens = min(c.tokens+now.Sub(c.last).Seconds()*c.rps, c.burst)
+	c.last = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// RetryAfter is the time until the next token becomes available.
+func (c *Ceiling) RetryAfter() time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - c.tokens) / c.rps * float64(time.Second))
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// takeChain takes cost from every level of a client chain, the client itself
+// first. The request is allowed only when every level allows it; callers must
+// discard the changes made to the chain otherwise. The decision reported is
+// that of the tightest level: on rejection the one that frees up last, else
+// the one with the least remaining. When the client delays requests over its
+// limit, every level that supports it reserves the tokens ahead of time. An
+// active temporary limit stands in for the limit of its level.
+func takeChain(chain []*models.Client, cost int, now time.Time) Decision {
+	maxDelay := maxDelayOf(chain[0])
+
+	var result Decision
+	for i, client := range chain {
+		restore := withTemporaryLimit(client, now)
+		var decision Decision
+		if reserver, ok := algorithmFor(client).(Reserver); ok && maxDelay > 0 {
+			decision = reserver.Reserve(client, cost, now, maxDelay)
+		} else {
+			decision = algorithmFor(client).Take(client, cost, now)
+		}
+		decision.Limit = client.Capacity
+		restore()
+		delay := max(result.Delay, decision.Delay)
+
+		switch {
+		case i == 0:
+			result = decision
+		case !decision.Allowed:
+			if result.Allowed || decision.RetryAfter > result.RetryAfter {
+				result = decision
+			}
+		case result.Allowed && decision.Remaining < result.Remaining:
+			result = decision
+		}
+		result.Delay = delay
+	}
+	if !result.Allowed {
+		result.Delay = 0
+	}
+	return result
+}
+
+// adjustChain credits or charges tokens to every level of a client chain.
+func adjustChain(chain []*models.Client, tokens int, now time.Time) {
+	for _, client := range chain {
+		restore := withTemporaryLimit(client, now)
+		algorithmFor(client).Adjust(client, tokens, now)
+		restore()
+	}
+}
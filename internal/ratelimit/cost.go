@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/dorik33/cloud/internal/config"
+)
+
+type costRules struct {
+	rules       []config.CostRule
+	defaultCost int
+}
+
+func newCostRules(cfg config.RateLimitConfig) (costRules, error) {
+	for i, rule := range cfg.CostRules {
+		if rule.Cost < 0 {
+			return costRules{}, fmt.Errorf("cost rule %d: cost must not be negative", i)
+		}
+		if rule.Path != "" {
+			if _, err := path.Match(rule.Path, "/"); err != nil {
+				return costRules{}, fmt.Errorf("cost rule %d: invalid path pattern %q: %w", i, rule.Path, err)
+			}
+		}
+		if rule.Value != "" && rule.Header == "" {
+			return costRules{}, fmt.Errorf("cost rule %d: value requires a header", i)
+		}
+	}
+	if cfg.DefaultCost < 0 {
+		return costRules{}, fmt.Errorf("default cost must not be negative")
+	}
+	return costRules{rules: cfg.CostRules, defaultCost: cfg.DefaultCost}, nil
+}
+
+// cost returns the cost of the first rule matching r, or the default cost.
+func (c costRules) cost(r *http.Request) int {
+	for _, rule := range c.rules {
+		if matches(rule, r) {
+			return rule.Cost
+		}
+	}
+	return c.defaultCost
+}
+
+func matches(rule config.CostRule, r *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	if rule.Route != "" && !strings.HasPrefix(r.URL.Path, rule.Route) {
+		return false
+	}
+	if rule.Path != "" {
+		if ok, _ := path.Match(rule.Path, r.URL.Path); !ok {
+			return false
+		}
+	}
+	if rule.Header != "" {
+		value := r.Header.Get(rule.Header)
+		if value == "" || (rule.Value != "" && value != rule.Value) {
+			return false
+		}
+	}
+	return true
+}
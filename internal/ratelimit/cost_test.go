@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dorik33/cloud/internal/config"
+)
+
+func TestCost(t *testing.T) {
+	costs, err := newCostRules(config.RateLimitConfig{
+		DefaultCost: 10,
+		CostRules: []config.CostRule{
+			{Path: "/health", Cost: 1},
+			{Method: "GET", Route: "/reports/", Cost: 50},
+			{Path: "/files/*/download", Cost: 5},
+			{Header: "X-Priority", Value: "low", Cost: 2},
+			{Header: "X-Batch", Cost: 100},
+		},
+	})
+	if err != nil {
+		t.Fatalf("newCostRules: %v", err)
+	}
+
+	tests := []struct {
+		method  string
+		target  string
+		headers map[string]string
+		want    int
+	}{
+		{method: "GET", target: "/", want: 10},
+		{method: "GET", target: "/health", want: 1},
+		{method: "GET", target: "/health/deep", want: 10},
+		{method: "GET", target: "/reports/daily", want: 50},
+		{method: "get", target: "/reports/daily", want: 50},
+		{method: "POST", target: "/reports/daily", want: 10},
+		{method: "GET", target: "/files/a.txt/download", want: 5},
+		{method: "GET", target: "/files/a/b/download", want: 10},
+		{method: "GET", target: "/", headers: map[string]string{"X-Priority": "low"}, want: 2},
+		{method: "GET", target: "/", headers: map[string]string{"X-Priority": "high"}, want: 10},
+		{method: "GET", target: "/", headers: map[string]string{"X-Batch": "yes"}, want: 100},
+		{method: "GET", target: "/health", headers: map[string]string{"X-Batch": "yes"}, want: 1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Method = tt.method
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		if got := costs.cost(r); got != tt.want {
+			t.Errorf("%s %s %v: cost = %d, want %d", tt.method, tt.target, tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestNewCostRulesInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.RateLimitConfig
+	}{
+		{name: "negative cost", cfg: config.RateLimitConfig{CostRules: []config.CostRule{{Path: "/", Cost: -1}}}},
+		{name: "bad pattern", cfg: config.RateLimitConfig{CostRules: []config.CostRule{{Path: "[", Cost: 1}}}},
+		{name: "value without header", cfg: config.RateLimitConfig{CostRules: []config.CostRule{{Value: "x", Cost: 1}}}},
+		{name: "negative default", cfg: config.RateLimitConfig{DefaultCost: -1}},
+	}
+	for _, tt := range tests {
+		if _, err := newCostRules(tt.cfg); err == nil {
+			t.Errorf("%s: newCostRules succeeded, want error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// What happens to a client's request over its limit: it is either rejected
+// with 429 or held until tokens are available, for at most the client's
+// MaxDelayMs.
+const (
+	OnLimitReject = "reject"
+	OnLimitDelay  = "delay"
+)
+
+func ValidOnLimit(onLimit string) bool {
+	return onLimit == OnLimitReject || onLimit == OnLimitDelay
+}
+
+// maxDelayOf returns how long a request of the client may wait for tokens, or
+// zero if it is rejected right away.
+func maxDelayOf(client *models.Client) time.Duration {
+	if client.OnLimit != OnLimitDelay {
+		return 0
+	}
+	return time.Duration(client.MaxDelayMs) * time.Millisecond
+}
+
+// Wait holds a request that AllowRequest admitted with a delay until its
+// tokens are due. When the client's delay queue is full it gives the tokens
+// back and returns a rejection; when ctx is done first it gives them back and
+// returns the context error.
+func (rl *RateLimiter) Wait(ctx context.Context, clientID string, cost int, decision Decision) (Decision, error) {
+	if !decision.Allowed || decision.Shadow || decision.Delay <= 0 {
+		return decision, nil
+	}
+	if !rl.enqueue(clientID, decision) {
+		slog.Debug("Delay queue full", "client_id", clientID, "queued", decision.maxQueued)
+		rl.refund(ctx, clientID, cost)
+		return Decision{Limit: decision.Limit, Window: decision.Window, Reset: decision.Reset, RetryAfter: decision.Delay}, nil
+	}
+	defer rl.dequeue(clientID)
+
+	slog.Debug("Delaying request", "client_id", clientID, "delay", decision.Delay)
+	timer := time.NewTimer(decision.Delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		rl.refund(ctx, clientID, cost)
+		return Decision{}, ctx.Err()
+	}
+	return decision, nil
+}
+
+// enqueue counts a delayed request of a client in delay mode against its
+// MaxQueued, reporting false when the queue is full. Requests of other
+// clients, which shaping algorithms delay within their capacity, are not
+// bounded here.
+func (rl *RateLimiter) enqueue(clientID string, decision Decision) bool {
+	if !decision.queue {
+		return true
+	}
+	rl.queueMux.Lock()
+	defer rl.queueMux.Unlock()
+
+	if decision.maxQueued > 0 && rl.queued[clientID] >= decision.maxQueued {
+		return false
+	}
+	rl.queued[clientID]++
+	return true
+}
+
+func (rl *RateLimiter) dequeue(clientID string) {
+	rl.queueMux.Lock()
+	defer rl.queueMux.Unlock()
+
+	if _, ok := rl.queued[clientID]; !ok {
+		return
+	}
+	rl.queued[clientID]--
+	if rl.queued[clientID] <= 0 {
+		delete(rl.queued, clientID)
+	}
+}
+
+// refund gives back the tokens reserved for a request that will not be
+// served, even if the request context is already done.
+func (rl *RateLimiter) refund(ctx context.Context, clientID string, cost int) {
+	if err := rl.limiter.adjust(context.WithoutCancel(ctx), clientID, cost); err != nil {
+		slog.Error("Failed to refund reserved tokens", "client_id", clientID, "tokens", cost, "error", err)
+	}
+}
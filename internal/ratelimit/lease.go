@@ -0,0 +1,234 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type lease struct {
+	mux      sync.Mutex
+	tokens   int
+	expires  time.Time
+	client   *models.Client
+	decision Decision
+	// released is set once the lease is dropped from the limiter, so no more
+	// tokens are borrowed into it.
+	released bool
+}
+
+// leaseLimiter borrows tokens from the central bucket in the clients table in
+// batches of size and spends them locally. Tokens left in a lease are given
+// back once it is ttl old, so replicas share a client's quota without a
+// database round trip per request. Shaping delays apply per borrowed batch.
+type leaseLimiter struct {
+	central postgresLimiter
+	size    int
+	ttl     time.Duration
+
+	mux    sync.Mutex
+	leases map[string]*lease
+
+	done chan struct{}
+}
+
+func newLeaseLimiter(repo store.ClientRepository, size int, ttl time.Duration) *leaseLimiter {
+	return &leaseLimiter{
+		central: postgresLimiter{repo: repo},
+		size:    size,
+		ttl:     ttl,
+		leases:  make(map[string]*lease),
+	}
+}
+
+func (l *leaseLimiter) start(ctx context.Context) error {
+	l.done = make(chan struct{})
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(l.ttl)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.returnLeases(ctx, false)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("Rate limit leases started", "size", l.size, "ttl", l.ttl)
+	return nil
+}
+
+func (l *leaseLimiter) close(ctx context.Context) error {
+	if l.done != nil {
+		<-l.done
+	}
+	l.returnLeases(ctx, true)
+	return nil
+}
+
+func (l *leaseLimiter) consume(ctx context.Context, clientID string, cost int) (*models.Client, Decision, error) {
+	ls := l.acquire(clientID)
+	defer ls.mux.Unlock()
+
+	if ls.tokens >= cost && ls.client != nil {
+		ls.tokens -= cost
+		// The last borrow may have been rejected, but this request is paid
+		// for by tokens already held.
+		decision := ls.decision
+		decision.Allowed = true
+		decision.Remaining = ls.client.Tokens + ls.tokens
+		decision.RetryAfter = 0
+		decision.Delay = 0
+		return ls.snapshot(), decision, nil
+	}
+
+	need := cost - ls.tokens
+	borrow := max(l.size, need)
+	if ls.client != nil && ls.client.OnLimit == OnLimitDelay {
+		// Borrowing a whole batch would reserve far more than the request
+		// waits for.
+		borrow = need
+	}
+	client, decision, err := l.central.consume(ctx, clientID, borrow)
+	if err == nil && client != nil && !decision.Allowed && borrow > need {
+		borrow = need
+		client, decision, err = l.central.consume(ctx, clientID, borrow)
+	}
+	if err != nil {
+		return nil, Decision{}, err
+	}
+	if client == nil {
+		l.mux.Lock()
+		delete(l.leases, clientID)
+		l.mux.Unlock()
+		ls.released = true
+		return nil, Decision{}, nil
+	}
+
+	ls.client = client
+	if decision.Allowed {
+		ls.tokens += borrow - cost
+		ls.expires = time.Now().Add(l.ttl)
+	}
+	decision.Remaining = client.Tokens + ls.tokens
+	ls.decision = decision
+	return ls.snapshot(), decision, nil
+}
+
+// acquire returns the client's lease, locked, creating it if needed.
+func (l *leaseLimiter) acquire(clientID string) *lease {
+	for {
+		l.mux.Lock()
+		ls, ok := l.leases[clientID]
+		if !ok {
+			ls = &lease{}
+			l.leases[clientID] = ls
+		}
+		l.mux.Unlock()
+
+		ls.mux.Lock()
+		if !ls.released {
+			return ls
+		}
+		ls.mux.Unlock()
+	}
+}
+
+func (l *leaseLimiter) adjust(ctx context.Context, clientID string, tokens int) error {
+	return l.central.adjust(ctx, clientID, tokens)
+}
+
+// modify gives the tokens leased for the client back first, so the change
+// applies to the whole bucket.
+func (l *leaseLimiter) modify(ctx context.Context, clientID string, fn func(client *models.Client, now time.Time)) (*models.Client, error) {
+	if err := l.release(ctx, clientID); err != nil {
+		return nil, err
+	}
+	return l.central.modify(ctx, clientID, fn)
+}
+
+// set gives the tokens leased for an updated client back, so its new limits
+// apply from the next request rather than once the lease expires.
+func (l *leaseLimiter) set(client *models.Client) {
+	if err := l.release(context.Background(), client.ClientID); err != nil {
+		slog.Error("Failed to return leased tokens", "client_id", client.ClientID, "error", err)
+	}
+}
+
+// release drops the client's lease and returns its unspent tokens to the
+// central bucket.
+func (l *leaseLimiter) release(ctx context.Context, clientID string) error {
+	l.mux.Lock()
+	ls, ok := l.leases[clientID]
+	delete(l.leases, clientID)
+	l.mux.Unlock()
+	if !ok {
+		return nil
+	}
+
+	ls.mux.Lock()
+	tokens := ls.tokens
+	ls.tokens = 0
+	ls.released = true
+	ls.mux.Unlock()
+	if tokens == 0 {
+		return nil
+	}
+	return l.central.adjust(ctx, clientID, tokens)
+}
+
+func (l *leaseLimiter) remove(clientID string) {
+	l.mux.Lock()
+	ls, ok := l.leases[clientID]
+	delete(l.leases, clientID)
+	l.mux.Unlock()
+	if ok {
+		ls.mux.Lock()
+		ls.released = true
+		ls.mux.Unlock()
+	}
+}
+
+// returnLeases gives unspent tokens back to the central buckets, either for
+// expired leases only or, on shutdown, for all of them.
+func (l *leaseLimiter) returnLeases(ctx context.Context, all bool) {
+	now := time.Now()
+
+	l.mux.Lock()
+	leases := make(map[string]*lease, len(l.leases))
+	for clientID, ls := range l.leases {
+		leases[clientID] = ls
+	}
+	l.mux.Unlock()
+
+	for clientID, ls := range leases {
+		ls.mux.Lock()
+		if ls.tokens == 0 || (!all && now.Before(ls.expires)) {
+			ls.mux.Unlock()
+			continue
+		}
+		tokens := ls.tokens
+		ls.tokens = 0
+		ls.mux.Unlock()
+
+		if err := l.central.adjust(ctx, clientID, tokens); err != nil {
+			slog.Error("Failed to return leased tokens", "client_id", clientID, "tokens", tokens, "error", err)
+			continue
+		}
+		slog.Debug("Leased tokens returned", "client_id", clientID, "tokens", tokens)
+	}
+}
+
+// snapshot reports the central bucket as of the last borrow plus the tokens
+// still held locally.
+func (ls *lease) snapshot() *models.Client {
+	client := *ls.client
+	client.Tokens += ls.tokens
+	return &client
+}
@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+// centralRepo is a token bucket without refill standing in for the clients
+// table. Only the calls a lease makes for a standalone client are provided.
+type centralRepo struct {
+	store.ClientRepository
+	client *models.Client
+}
+
+func (r *centralRepo) Consume(_ context.Context, clientID string, cost int) (*models.Client, bool, error) {
+	if clientID != r.client.ClientID {
+		return nil, false, nil
+	}
+	allowed := r.client.Tokens >= cost
+	if allowed {
+		r.client.Tokens -= cost
+	}
+	client := *r.client
+	return &client, allowed, nil
+}
+
+type leaseStep struct {
+	cost      int
+	allowed   bool
+	remaining int
+}
+
+func TestLeaseConsume(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		steps []leaseStep
+	}{
+		{
+			name: "reject, then a small request fits the leftover tokens",
+			size: 5,
+			steps: []leaseStep{
+				{cost: 1, allowed: true, remaining: 7},
+				{cost: 10, allowed: false, remaining: 7},
+				{cost: 1, allowed: true, remaining: 6},
+				{cost: 3, allowed: true, remaining: 3},
+			},
+		},
+		{
+			name: "falls back to borrowing only what the request needs",
+			size: 5,
+			steps: []leaseStep{
+				{cost: 7, allowed: true, remaining: 1},
+				{cost: 2, allowed: false, remaining: 1},
+				{cost: 1, allowed: true, remaining: 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &centralRepo{client: &models.Client{
+				ClientID: "test", Algorithm: "token_bucket", Capacity: 8, RatePerSec: 1,
+				Tokens: 8, LastRefill: time.Now(), OnLimit: OnLimitReject,
+			}}
+			l := newLeaseLimiter(repo, tt.size, time.Minute)
+			for i, s := range tt.steps {
+				client, decision, err := l.consume(context.Background(), "test", s.cost)
+				if err != nil {
+					t.Fatalf("step %d: consume() error = %v", i, err)
+				}
+				if client == nil {
+					t.Fatalf("step %d: consume() returned no client", i)
+				}
+				if decision.Allowed != s.allowed || decision.Remaining != s.remaining {
+					t.Errorf("step %d: allowed = %v, remaining = %d, want %v, %d",
+						i, decision.Allowed, decision.Remaining, s.allowed, s.remaining)
+				}
+				if decision.Allowed && decision.RetryAfter != 0 {
+					t.Errorf("step %d: allowed with retry after %v", i, decision.RetryAfter)
+				}
+			}
+		})
+	}
+}
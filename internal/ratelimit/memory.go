@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+// memoryLimiter keeps every client bucket in process and writes changed
+// buckets back to the clients table in batches.
+type memoryLimiter struct {
+	repo          store.ClientRepository
+	flushInterval time.Duration
+
+	mux     sync.Mutex
+	clients map[string]*models.Client
+	dirty   map[string]struct{}
+
+	done chan struct{}
+}
+
+func newMemoryLimiter(repo store.ClientRepository, flushInterval time.Duration) *memoryLimiter {
+	return &memoryLimiter{
+		repo:          repo,
+		flushInterval: flushInterval,
+		clients:       make(map[string]*models.Client),
+		dirty:         make(map[string]struct{}),
+	}
+}
+
+func (m *memoryLimiter) start(ctx context.Context) error {
+	clients, err := m.repo.GetAllClients(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	for _, client := range clients {
+		m.clients[client.ClientID] = client
+	}
+	m.mux.Unlock()
+	slog.Info("Rate limit buckets loaded", "clients", len(clients))
+
+	m.done = make(chan struct{})
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.flush(ctx); err != nil {
+					slog.Error("Failed to flush rate limit buckets", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("Rate limit flush started", "interval", m.flushInterval)
+	return nil
+}
+
+func (m *memoryLimiter) close(ctx context.Context) error {
+	if m.done != nil {
+		<-m.done
+	}
+	return m.flush(ctx)
+}
+
+func (m *memoryLimiter) consume(ctx context.Context, clientID string, cost int) (*models.Client, Decision, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	chain := m.chainOf(clientID)
+	if len(chain) == 0 {
+		return nil, Decision{}, nil
+	}
+
+	decision := takeChain(chain, cost, time.Now())
+	if decision.Allowed {
+		for _, client := range chain {
+			m.clients[client.ClientID] = client
+			m.dirty[client.ClientID] = struct{}{}
+		}
+	}
+	return snapshotOf(chain[0]), decision, nil
+}
+
+func (m *memoryLimiter) adjust(ctx context.Context, clientID string, tokens int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	chain := m.chainOf(clientID)
+	adjustChain(chain, tokens, time.Now())
+	for _, client := range chain {
+		m.clients[client.ClientID] = client
+		m.dirty[client.ClientID] = struct{}{}
+	}
+	return nil
+}
+
+func (m *memoryLimiter) modify(ctx context.Context, clientID string, fn func(client *models.Client, now time.Time)) (*models.Client, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	client, ok := m.clients[clientID]
+	if !ok {
+		return nil, nil
+	}
+	fn(client, time.Now())
+	m.dirty[clientID] = struct{}{}
+	return snapshotOf(client), nil
+}
+
+// chainOf returns copies of a client and its ancestors, the client first, so
+// a rejected request can leave the stored buckets untouched. The caller must
+// hold m.mux.
+func (m *memoryLimiter) chainOf(clientID string) []*models.Client {
+	var chain []*models.Client
+	for clientID != "" && len(chain) < models.MaxChainDepth {
+		client, ok := m.clients[clientID]
+		if !ok {
+			break
+		}
+		chain = append(chain, snapshotOf(client))
+		clientID = client.ParentID
+	}
+	return chain
+}
+
+func (m *memoryLimiter) set(client *models.Client) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	current, ok := m.clients[client.ClientID]
+	if !ok || current.Algorithm != client.Algorithm || current.WindowSeconds != client.WindowSeconds {
+		m.clients[client.ClientID] = snapshotOf(client)
+		m.dirty[client.ClientID] = struct{}{}
+		return
+	}
+
+	algorithmFor(current).Adjust(current, 0, time.Now())
+	current.ParentID = client.ParentID
+	current.PlanID = client.PlanID
+	current.Overrides = client.Overrides
+	current.Capacity = client.Capacity
+	current.RatePerSec = client.RatePerSec
+	current.Shadow = client.Shadow
+	current.OnLimit = client.OnLimit
+	current.MaxDelayMs = client.MaxDelayMs
+	current.MaxQueued = client.MaxQueued
+	current.RequestBytesPerSec = client.RequestBytesPerSec
+	current.ResponseBytesPerSec = client.ResponseBytesPerSec
+	current.UpdatedAt = client.UpdatedAt
+	current.Version = client.Version
+	current.Temporary = client.Temporary
+	capacity := current.Capacity
+	if current.Temporary.Active(time.Now()) {
+		capacity = max(capacity, current.Temporary.Capacity)
+	}
+	if current.Tokens > capacity {
+		current.Tokens = capacity
+	}
+	m.dirty[client.ClientID] = struct{}{}
+}
+
+func (m *memoryLimiter) remove(clientID string) {
+	m.mux.Lock()
+	delete(m.clients, clientID)
+	delete(m.dirty, clientID)
+	m.mux.Unlock()
+}
+
+func (m *memoryLimiter) flush(ctx context.Context) error {
+	m.mux.Lock()
+	if len(m.dirty) == 0 {
+		m.mux.Unlock()
+		return nil
+	}
+	batch := make([]*models.Client, 0, len(m.dirty))
+	for clientID := range m.dirty {
+		if client, ok := m.clients[clientID]; ok {
+			batch = append(batch, snapshotOf(client))
+		}
+	}
+	m.dirty = make(map[string]struct{})
+	m.mux.Unlock()
+
+	if err := m.repo.SaveTokens(ctx, batch); err != nil {
+		m.mux.Lock()
+		for _, client := range batch {
+			if _, ok := m.clients[client.ClientID]; ok {
+				m.dirty[client.ClientID] = struct{}{}
+			}
+		}
+		m.mux.Unlock()
+		return err
+	}
+
+	slog.Debug("Rate limit buckets flushed", "clients", len(batch))
+	return nil
+}
+
+// snapshotOf copies a client, including its sliding log, so the copy can be
+// used after the lock is released.
+func snapshotOf(client *models.Client) *models.Client {
+	snapshot := *client
+	snapshot.State.Log = append([]models.LogEntry(nil), client.State.Log...)
+	return &snapshot
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+// QuotaDecision is the outcome of counting a request against a client's
+// long-window quotas. Quota is the exceeded quota on rejection, otherwise the
+// one with the least room left; it is nil for clients without quotas.
+type QuotaDecision struct {
+	Allowed bool
+	Quota   *models.Quota
+}
+
+func ValidQuotaPeriod(period string) bool {
+	return period == QuotaPeriodDay || period == QuotaPeriodMonth
+}
+
+// ConsumeQuota counts one request against all quotas of the client. The
+// quotas live in Postgres in every rate limiting mode, since they have to
+// survive restarts and be shared by all replicas.
+func (rl *RateLimiter) ConsumeQuota(ctx context.Context, clientID string) (QuotaDecision, error) {
+	quotas, allowed, err := rl.quotas.Consume(ctx, clientID, 1)
+	if err != nil {
+		slog.Error("Failed to consume client quotas", "client_id", clientID, "error", err)
+		return QuotaDecision{}, err
+	}
+
+	decision := QuotaDecision{Allowed: allowed}
+	for _, quota := range quotas {
+		exceeded := quota.Used >= quota.Limit
+		if decision.Quota == nil ||
+			(!allowed && exceeded) ||
+			quota.Limit-quota.Used < decision.Quota.Limit-decision.Quota.Used {
+			decision.Quota = quota
+		}
+		if !allowed && exceeded {
+			break
+		}
+	}
+
+	if !allowed {
+		slog.Debug("Quota exceeded", "client_id", clientID, "period", decision.Quota.Period, "limit", decision.Quota.Limit)
+	}
+	return decision, nil
+}
+
+// RefundQuota gives back the request ConsumeQuota counted for a request that
+// was not served, even if the request context is already done.
+func (rl *RateLimiter) RefundQuota(ctx context.Context, clientID string) {
+	if err := rl.quotas.Refund(context.WithoutCancel(ctx), clientID, 1); err != nil {
+		slog.Error("Failed to refund client quotas", "client_id", clientID, "error", err)
+	}
+}
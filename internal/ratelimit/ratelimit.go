@@ -2,86 +2,216 @@ package ratelimit
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"net/http"
+	"sync"
 	"time"
 
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/models"
 	"github.com/dorik33/cloud/internal/store"
 )
 
+// limiter is the storage strategy behind RateLimiter. consume and modify
+// return a nil client when it does not exist.
+type limiter interface {
+	consume(ctx context.Context, clientID string, cost int) (*models.Client, Decision, error)
+	adjust(ctx context.Context, clientID string, tokens int) error
+	modify(ctx context.Context, clientID string, fn func(client *models.Client, now time.Time)) (*models.Client, error)
+	start(ctx context.Context) error
+	close(ctx context.Context) error
+	set(client *models.Client)
+	remove(clientID string)
+}
+
 type RateLimiter struct {
-	repo store.ClientRepository
+	repo       store.ClientRepository
+	quotas     store.QuotaRepository
+	limiter    limiter
+	costs      costRules
+	costHeader string
+	shadow     bool
+	shadows    *shadowRecorder
+
+	queueMux sync.Mutex
+	queued   map[string]int
+
+	pacersMux sync.Mutex
+	pacers    map[string]*clientPacers
+}
+
+func NewRateLimiter(repo store.ClientRepository, quotas store.QuotaRepository, shadows store.ShadowRepository, cfg config.RateLimitConfig) (*RateLimiter, error) {
+	costs, err := newCostRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rl := &RateLimiter{
+		repo:       repo,
+		quotas:     quotas,
+		costs:      costs,
+		costHeader: cfg.CostHeader,
+		shadow:     cfg.Shadow,
+		shadows:    newShadowRecorder(shadows, cfg.FlushInterval),
+		queued:     make(map[string]int),
+		pacers:     make(map[string]*clientPacers),
+	}
+	switch cfg.Mode {
+	case config.RateLimitModePostgres:
+		rl.limiter = postgresLimiter{repo: repo}
+	case config.RateLimitModeMemory:
+		rl.limiter = newMemoryLimiter(repo, cfg.FlushInterval)
+	case config.RateLimitModeLease:
+		rl.limiter = newLeaseLimiter(repo, cfg.LeaseSize, cfg.LeaseTTL)
+	default:
+		return nil, fmt.Errorf("unknown rate limit mode %q", cfg.Mode)
+	}
+	slog.Info("Rate limiter configured", "mode", cfg.Mode, "shadow", cfg.Shadow)
+	return rl, nil
+}
+
+// Start loads whatever state the configured mode keeps in process and starts
+// its background work.
+func (rl *RateLimiter) Start(ctx context.Context) error {
+	if err := rl.limiter.start(ctx); err != nil {
+		return err
+	}
+	rl.shadows.start(ctx)
+	return nil
+}
+
+// Close persists or returns any bucket state held in process.
+func (rl *RateLimiter) Close(ctx context.Context) error {
+	if err := rl.shadows.close(ctx); err != nil {
+		slog.Error("Failed to flush shadow denials", "error", err)
+	}
+	return rl.limiter.close(ctx)
+}
+
+// SetClient makes a created or updated client visible to the limiter.
+func (rl *RateLimiter) SetClient(client *models.Client) {
+	rl.limiter.set(client)
+	rl.setPacers(client)
 }
 
-func NewRateLimiter(repo store.ClientRepository) *RateLimiter {
-	return &RateLimiter{repo: repo}
+// RemoveClient drops a deleted client from the limiter.
+func (rl *RateLimiter) RemoveClient(clientID string) {
+	rl.limiter.remove(clientID)
+	rl.removePacers(clientID)
 }
 
-func (rl *RateLimiter) AllowRequest(ctx context.Context, clientID string) (bool, error) {
-	client, err := rl.repo.GetByIDForUpdate(ctx, clientID)
+// Cost returns the number of tokens a request is admitted with.
+func (rl *RateLimiter) Cost(r *http.Request) int {
+	return rl.costs.cost(r)
+}
+
+// CostHeader is the response header backends use to report the actual cost
+// of a request. It is empty when post-hoc charging is disabled.
+func (rl *RateLimiter) CostHeader() string {
+	return rl.costHeader
+}
+
+// Charge takes tokens from a client after the fact, without checking its
+// limit. A negative amount gives tokens back.
+func (rl *RateLimiter) Charge(ctx context.Context, clientID string, tokens int) error {
+	if tokens == 0 {
+		return nil
+	}
+	if err := rl.limiter.adjust(ctx, clientID, -tokens); err != nil {
+		slog.Error("Failed to charge client tokens", "client_id", clientID, "tokens", tokens, "error", err)
+		return err
+	}
+	slog.Debug("Client charged", "client_id", clientID, "tokens", tokens)
+	return nil
+}
+
+// AllowRequest takes cost tokens from the client and each of its ancestors and
+// reports the state of the tightest limit. Unknown clients are rejected with
+// an empty decision. In shadow mode, globally or for the client, a rejection
+// is logged and counted but the request is allowed. An allowed request with a
+// Delay must be held with Wait before it is served.
+func (rl *RateLimiter) AllowRequest(ctx context.Context, clientID string, cost int) (Decision, error) {
+	client, decision, err := rl.limiter.consume(ctx, clientID, cost)
 	if err != nil {
-		slog.Error("Failed to get client for rate limiting", "client_id", clientID, "error", err)
-		return false, err
+		slog.Error("Failed to consume client tokens", "client_id", clientID, "error", err)
+		return Decision{}, err
 	}
 	if client == nil {
 		slog.Error("Client not found for rate limiting", "client_id", clientID)
-		return false, nil
+		return Decision{}, nil
 	}
+	rl.setPacers(client)
 
-	if client.Tokens < 10 {
-		slog.Debug("Rate limit exceeded", "client_id", clientID, "tokens", client.Tokens)
-		return false, nil
+	if !decision.Allowed && (rl.shadow || client.Shadow) {
+		slog.Warn("Shadow rate limit denial", "client_id", clientID, "algorithm", client.Algorithm, "cost", cost, "remaining", decision.Remaining)
+		rl.shadows.record(clientID, time.Now())
+		decision.Allowed = true
+		decision.Shadow = true
+		return decision, nil
 	}
 
-	client.Tokens -= 10
-	client.LastRefill = time.Now()
-
-	if err := rl.repo.Update(ctx, client); err != nil {
-		slog.Error("Failed to update client tokens", "client_id", clientID, "error", err)
-		return false, err
+	if !decision.Allowed {
+		slog.Debug("Rate limit exceeded", "client_id", clientID, "algorithm", client.Algorithm, "cost", cost, "remaining", decision.Remaining, "retry_after", decision.RetryAfter)
+		return decision, nil
 	}
 
-	slog.Debug("Request allowed", "client_id", clientID, "tokens", client.Tokens)
-	return true, nil
+	decision.queue = client.OnLimit == OnLimitDelay
+	decision.maxQueued = client.MaxQueued
+	slog.Debug("Request allowed", "client_id", clientID, "algorithm", client.Algorithm, "cost", cost, "remaining", decision.Remaining)
+	return decision, nil
 }
 
-func (rl *RateLimiter) RefillAllTokens(ctx context.Context) error {
-	clients, err := rl.repo.GetAllClients(ctx)
+// postgresLimiter spends tokens directly in the clients table, so every
+// balancer replica sees the same buckets. Token buckets without a parent are
+// handled by a single statement; other clients run in a transaction holding
+// the row locks of the whole chain.
+type postgresLimiter struct {
+	repo store.ClientRepository
+}
+
+func (p postgresLimiter) consume(ctx context.Context, clientID string, cost int) (*models.Client, Decision, error) {
+	client, allowed, err := p.repo.Consume(ctx, clientID, cost)
 	if err != nil {
-		slog.Error("Failed to get all clients for token refill", "error", err)
-		return err
+		return nil, Decision{}, err
+	}
+	if client != nil {
+		decision := tokenBucketDecision(client, allowed, cost, time.Now())
+		decision.Limit = client.Capacity
+		return client, decision, nil
 	}
 
-	for _, client := range clients {
-		client, err := rl.repo.GetByIDForUpdate(ctx, client.ClientID)
-		if err != nil {
-			slog.Error("Failed to get client for token refill", "client_id", client.ClientID, "error", err)
-			continue
-		}
-		if client == nil {
-			slog.Warn("Client not found during token refill", "client_id", client.ClientID)
-			continue
-		}
-		if client.Tokens < client.Capacity {
-			client.Tokens += client.RatePerSec
-			rl.repo.Update(ctx, client)
-		}
+	var decision Decision
+	chain, _, err := p.repo.UpdateChain(ctx, clientID, func(chain []*models.Client) bool {
+		decision = takeChain(chain, cost, time.Now())
+		return decision.Allowed
+	})
+	if err != nil || len(chain) == 0 {
+		return nil, Decision{}, err
 	}
-	return nil
+	return chain[0], decision, nil
 }
 
-func (rl *RateLimiter) StartRefillTicker(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Second)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				rl.RefillAllTokens(ctx)
-			case <-ctx.Done():
-				ticker.Stop()
-
-				return
-			}
-		}
-	}()
-	slog.Info("Token refill ticker started")
+func (p postgresLimiter) adjust(ctx context.Context, clientID string, tokens int) error {
+	_, _, err := p.repo.UpdateChain(ctx, clientID, func(chain []*models.Client) bool {
+		adjustChain(chain, tokens, time.Now())
+		return true
+	})
+	return err
 }
+
+func (p postgresLimiter) modify(ctx context.Context, clientID string, fn func(client *models.Client, now time.Time)) (*models.Client, error) {
+	chain, _, err := p.repo.UpdateChain(ctx, clientID, func(chain []*models.Client) bool {
+		fn(chain[0], time.Now())
+		return true
+	})
+	if err != nil || len(chain) == 0 {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+func (postgresLimiter) start(context.Context) error { return nil }
+func (postgresLimiter) close(context.Context) error { return nil }
+func (postgresLimiter) set(*models.Client)          {}
+func (postgresLimiter) remove(string)               {}
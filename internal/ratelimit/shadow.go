@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type shadowKey struct {
+	clientID string
+	minute   time.Time
+}
+
+// shadowRecorder counts shadow denials per client and minute in process and
+// adds them to the shadow_denials table every flushInterval.
+type shadowRecorder struct {
+	repo          store.ShadowRepository
+	flushInterval time.Duration
+
+	mux    sync.Mutex
+	counts map[shadowKey]int64
+
+	done chan struct{}
+}
+
+func newShadowRecorder(repo store.ShadowRepository, flushInterval time.Duration) *shadowRecorder {
+	return &shadowRecorder{
+		repo:          repo,
+		flushInterval: flushInterval,
+		counts:        make(map[shadowKey]int64),
+	}
+}
+
+func (s *shadowRecorder) start(ctx context.Context) {
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flush(ctx); err != nil {
+					slog.Error("Failed to flush shadow denials", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (s *shadowRecorder) close(ctx context.Context) error {
+	if s.done != nil {
+		<-s.done
+	}
+	return s.flush(ctx)
+}
+
+func (s *shadowRecorder) record(clientID string, now time.Time) {
+	s.mux.Lock()
+	s.counts[shadowKey{clientID: clientID, minute: now.UTC().Truncate(time.Minute)}]++
+	s.mux.Unlock()
+}
+
+func (s *shadowRecorder) flush(ctx context.Context) error {
+	s.mux.Lock()
+	if len(s.counts) == 0 {
+		s.mux.Unlock()
+		return nil
+	}
+	counts := s.counts
+	s.counts = make(map[shadowKey]int64)
+	s.mux.Unlock()
+
+	denials := make([]*models.ShadowDenial, 0, len(counts))
+	for key, n := range counts {
+		denials = append(denials, &models.ShadowDenial{ClientID: key.clientID, Minute: key.minute, Denials: n})
+	}
+	if err := s.repo.Record(ctx, denials); err != nil {
+		s.mux.Lock()
+		for key, n := range counts {
+			s.counts[key] += n
+		}
+		s.mux.Unlock()
+		return err
+	}
+
+	slog.Debug("Shadow denials flushed", "counts", len(denials))
+	return nil
+}
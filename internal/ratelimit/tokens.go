@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// Administrative changes to a client's bucket.
+const (
+	TokensReset = "reset"
+	TokensAdd   = "add"
+	TokensDrain = "drain"
+)
+
+// withTemporaryLimit makes an active temporary limit the client's capacity and
+// rate. The returned function restores the client's own, so that only the
+// bucket state, never the boosted limits, is stored.
+func withTemporaryLimit(client *models.Client, now time.Time) func() {
+	if !client.Temporary.Active(now) {
+		return func() {}
+	}
+	capacity, rate := client.Capacity, client.RatePerSec
+	client.Capacity, client.RatePerSec = client.Temporary.Capacity, client.Temporary.RatePerSec
+	return func() {
+		client.Capacity, client.RatePerSec = capacity, rate
+	}
+}
+
+// changeTokens applies an administrative action to a client's bucket: reset
+// gives it a fresh limiter, add credits tokens up to its capacity and drain
+// leaves nothing to spend. An active temporary limit counts as the capacity.
+func changeTokens(client *models.Client, action string, tokens int, now time.Time) {
+	defer withTemporaryLimit(client, now)()
+
+	switch action {
+	case TokensReset:
+		client.State = models.LimiterState{}
+		client.Tokens = client.Capacity
+		client.LastRefill = now
+	case TokensAdd:
+		algorithmFor(client).Adjust(client, tokens, now)
+	case TokensDrain:
+		algorithmFor(client).Adjust(client, -client.Capacity, now)
+	}
+}
+
+// ChangeTokens resets, adds to or drains a client's bucket right away. Its
+// ancestors are left alone. A missing client yields nil, nil.
+func (rl *RateLimiter) ChangeTokens(ctx context.Context, clientID, action string, tokens int) (*models.Client, error) {
+	client, err := rl.limiter.modify(ctx, clientID, func(client *models.Client, now time.Time) {
+		changeTokens(client, action, tokens, now)
+	})
+	if err != nil {
+		slog.Error("Failed to change client tokens", "client_id", clientID, "action", action, "error", err)
+		return nil, err
+	}
+	return client, nil
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ACLRepository stores acl rules. Create fails with ErrUnknownReference when
+// a rule names a client that does not exist.
+type ACLRepository interface {
+	Create(ctx context.Context, rule *models.ACLRule) error
+	GetAll(ctx context.Context) ([]*models.ACLRule, error)
+	Delete(ctx context.Context, id int64) (bool, error)
+}
+
+type aclRepository struct {
+	store *Store
+}
+
+func (r *aclRepository) Create(ctx context.Context, rule *models.ACLRule) error {
+	query := `
+		INSERT INTO acl_rules (action, cidr, route, client_id)
+		VALUES ($1, $2::cidr, NULLIF($3, ''), NULLIF($4, ''))
+		RETURNING id, cidr::text, created_at
+	`
+	err := r.store.pool.QueryRow(ctx, query,
+		rule.Action, rule.CIDR, rule.Route, rule.ClientID).Scan(&rule.ID, &rule.CIDR, &rule.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return ErrUnknownReference
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create acl rule: %w", err)
+	}
+	return nil
+}
+
+func (r *aclRepository) GetAll(ctx context.Context) ([]*models.ACLRule, error) {
+	query := `
+		SELECT id, action, cidr::text, COALESCE(route, ''), COALESCE(client_id, ''), created_at
+		FROM acl_rules ORDER BY id
+	`
+	rows, err := r.store.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get acl rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []*models.ACLRule
+	for rows.Next() {
+		rule := &models.ACLRule{}
+		if err := rows.Scan(&rule.ID, &rule.Action, &rule.CIDR, &rule.Route, &rule.ClientID, &rule.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan acl rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating acl rules: %w", err)
+	}
+
+	return rules, nil
+}
+
+func (r *aclRepository) Delete(ctx context.Context, id int64) (bool, error) {
+	query := `DELETE FROM acl_rules WHERE id = $1`
+	tag, err := r.store.pool.Exec(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete acl rule %d: %w", id, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
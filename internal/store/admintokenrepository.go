@@ -0,0 +1,138 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrAdminTokenExists = errors.New("admin token already exists")
+
+// AdminTokenRepository stores management API tokens by the hash of their
+// secret. GetByID and Authenticate yield nil, nil for unknown tokens.
+type AdminTokenRepository interface {
+	Create(ctx context.Context, token *models.AdminToken, hash string) error
+	GetAll(ctx context.Context) ([]*models.AdminToken, error)
+	GetByID(ctx context.Context, id int64) (*models.AdminToken, error)
+	Update(ctx context.Context, token *models.AdminToken) (bool, error)
+	Delete(ctx context.Context, id int64) (bool, error)
+	Authenticate(ctx context.Context, hash string) (*models.AdminToken, error)
+}
+
+type adminTokenRepository struct {
+	store *Store
+}
+
+const adminTokenColumns = `id, name, role, created_at, last_used_at`
+
+func scanAdminToken(row pgx.Row) (*models.AdminToken, error) {
+	token := &models.AdminToken{}
+	if err := row.Scan(&token.ID, &token.Name, &token.Role, &token.CreatedAt, &token.LastUsedAt); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *adminTokenRepository) Create(ctx context.Context, token *models.AdminToken, hash string) error {
+	query := `
+		INSERT INTO admin_tokens (name, role, token_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`
+	err := r.store.pool.QueryRow(ctx, query, token.Name, token.Role, hash).Scan(&token.ID, &token.CreatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrAdminTokenExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create admin token: %w", err)
+	}
+	return nil
+}
+
+func (r *adminTokenRepository) GetAll(ctx context.Context) ([]*models.AdminToken, error) {
+	query := `SELECT ` + adminTokenColumns + ` FROM admin_tokens ORDER BY id`
+	rows, err := r.store.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*models.AdminToken{}
+	for rows.Next() {
+		token, err := scanAdminToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan admin token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating admin tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+func (r *adminTokenRepository) GetByID(ctx context.Context, id int64) (*models.AdminToken, error) {
+	query := `SELECT ` + adminTokenColumns + ` FROM admin_tokens WHERE id = $1`
+	token, err := scanAdminToken(r.store.pool.QueryRow(ctx, query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get admin token %d: %w", id, err)
+	}
+	return token, nil
+}
+
+// Update renames a token or changes its role. The secret stays the same.
+func (r *adminTokenRepository) Update(ctx context.Context, token *models.AdminToken) (bool, error) {
+	query := `
+		UPDATE admin_tokens SET name = $2, role = $3
+		WHERE id = $1
+		RETURNING created_at, last_used_at
+	`
+	err := r.store.pool.QueryRow(ctx, query, token.ID, token.Name, token.Role).Scan(&token.CreatedAt, &token.LastUsedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return false, ErrAdminTokenExists
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update admin token %d: %w", token.ID, err)
+	}
+	return true, nil
+}
+
+func (r *adminTokenRepository) Delete(ctx context.Context, id int64) (bool, error) {
+	query := `DELETE FROM admin_tokens WHERE id = $1`
+	tag, err := r.store.pool.Exec(ctx, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete admin token %d: %w", id, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Authenticate looks a token up by the hash of its secret and records that
+// it was used.
+func (r *adminTokenRepository) Authenticate(ctx context.Context, hash string) (*models.AdminToken, error) {
+	query := `
+		UPDATE admin_tokens SET last_used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1
+		RETURNING ` + adminTokenColumns
+	token, err := scanAdminToken(r.store.pool.QueryRow(ctx, query, hash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate admin token: %w", err)
+	}
+	return token, nil
+}
@@ -2,11 +2,26 @@ package store
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/dorik33/cloud/internal/models"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrClientHasChildren = errors.New("client has child clients")
+	ErrInvalidCursor     = errors.New("invalid cursor")
+	ErrVersionConflict   = errors.New("client was changed concurrently")
+	ErrClientExists      = errors.New("client already exists")
+	ErrUnknownReference  = errors.New("referenced client or plan does not exist")
+	ErrInvalidHierarchy  = errors.New("client would be its own ancestor or too deep in the hierarchy")
 )
 
 type ClientRepository interface {
@@ -14,8 +29,111 @@ type ClientRepository interface {
 	GetByID(ctx context.Context, clientID string) (*models.Client, error)
 	GetByIDForUpdate(ctx context.Context, clientID string) (*models.Client, error)
 	GetAllClients(ctx context.Context) ([]*models.Client, error)
+	List(ctx context.Context, query *models.ClientQuery) ([]*models.Client, string, error)
+	Consume(ctx context.Context, clientID string, cost int) (*models.Client, bool, error)
+	GetChain(ctx context.Context, clientID string) ([]*models.Client, error)
+	UpdateChain(ctx context.Context, clientID string, fn func(chain []*models.Client) bool) ([]*models.Client, bool, error)
+	SaveTokens(ctx context.Context, clients []*models.Client) error
 	Update(ctx context.Context, client *models.Client) error
-	Delete(ctx context.Context, clientID string) error
+	Delete(ctx context.Context, clientID string) (bool, error)
+	Import(ctx context.Context, clients []*models.Client, mode string) ([]string, error)
+	Export(ctx context.Context, fn func(client *models.Client) error) error
+	SetTemporaryLimit(ctx context.Context, clientID string, version int64, limit *models.TemporaryLimit) (*models.Client, error)
+}
+
+const (
+	clientColumns = `client_id, parent_id, plan_id, overrides, capacity, rate_per_sec, algorithm, window_seconds,
+		shadow, on_limit, max_delay_ms, max_queued, request_bytes_per_sec, response_bytes_per_sec, tokens, last_refill, state, created_at, updated_at, version,
+		temp_capacity, temp_rate_per_sec, temp_expires_at, temp_applied_by, temp_applied_at, temp_reason`
+	qualifiedClientColumns = `c.client_id, c.parent_id, c.plan_id, c.overrides, c.capacity, c.rate_per_sec, c.algorithm, c.window_seconds,
+		c.shadow, c.on_limit, c.max_delay_ms, c.max_queued, c.request_bytes_per_sec, c.response_bytes_per_sec, c.tokens, c.last_refill, c.state, c.created_at, c.updated_at, c.version,
+		c.temp_capacity, c.temp_rate_per_sec, c.temp_expires_at, c.temp_applied_by, c.temp_applied_at, c.temp_reason`
+)
+
+// scanClient reads a row selected with clientColumns, followed by any extra
+// columns the query appends.
+func scanClient(row pgx.Row, extra ...any) (*models.Client, error) {
+	client := &models.Client{}
+	var parentID, planID, tempAppliedBy, tempReason *string
+	var tempCapacity, tempRate *int
+	var tempExpiresAt, tempAppliedAt *time.Time
+	dest := []any{
+		&client.ClientID, &parentID, &planID, &client.Overrides, &client.Capacity, &client.RatePerSec,
+		&client.Algorithm, &client.WindowSeconds, &client.Shadow,
+		&client.OnLimit, &client.MaxDelayMs, &client.MaxQueued, &client.RequestBytesPerSec,
+		&client.ResponseBytesPerSec, &client.Tokens, &client.LastRefill, &client.State,
+		&client.CreatedAt, &client.UpdatedAt, &client.Version,
+		&tempCapacity, &tempRate, &tempExpiresAt, &tempAppliedBy, &tempAppliedAt, &tempReason,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if tempCapacity != nil && tempRate != nil && tempExpiresAt != nil {
+		client.Temporary = &models.TemporaryLimit{
+			Capacity:   *tempCapacity,
+			RatePerSec: *tempRate,
+			ExpiresAt:  *tempExpiresAt,
+		}
+		if tempAppliedBy != nil {
+			client.Temporary.AppliedBy = *tempAppliedBy
+		}
+		if tempAppliedAt != nil {
+			client.Temporary.AppliedAt = *tempAppliedAt
+		}
+		if tempReason != nil {
+			client.Temporary.Reason = *tempReason
+		}
+	}
+	if parentID != nil {
+		client.ParentID = *parentID
+	}
+	if planID != nil {
+		client.PlanID = *planID
+	}
+	return client, nil
+}
+
+// chainQuery selects a client and its ancestors, up to models.MaxChainDepth
+// levels, ordered by client_id so that concurrent transactions locking
+// overlapping chains take the row locks in the same order. The depth of each
+// row is appended after clientColumns.
+const chainQuery = `
+	WITH RECURSIVE chain AS (
+		SELECT client_id, parent_id, 0 AS depth FROM clients WHERE client_id = $1
+		UNION ALL
+		SELECT p.client_id, p.parent_id, chain.depth + 1
+		FROM clients p JOIN chain ON p.client_id = chain.parent_id
+		WHERE chain.depth + 1 < $2
+	)
+	SELECT ` + qualifiedClientColumns + `, chain.depth
+	FROM clients c JOIN chain ON chain.client_id = c.client_id
+	ORDER BY c.client_id
+`
+
+// scanChain reads the rows of chainQuery and returns the clients ordered from
+// the client itself up to its topmost ancestor.
+func scanChain(rows pgx.Rows) ([]*models.Client, error) {
+	defer rows.Close()
+
+	var chain []*models.Client
+	depths := make(map[string]int)
+	for rows.Next() {
+		var depth int
+		client, err := scanClient(rows, &depth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan client: %w", err)
+		}
+		chain = append(chain, client)
+		depths[client.ClientID] = depth
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(chain, func(a, b *models.Client) int {
+		return depths[a.ClientID] - depths[b.ClientID]
+	})
+	return chain, nil
 }
 
 type clientRepository struct {
@@ -24,12 +142,21 @@ type clientRepository struct {
 
 func (r *clientRepository) Create(ctx context.Context, client *models.Client) error {
 	query := `
-		INSERT INTO clients (client_id, capacity, rate_per_sec, tokens, last_refill, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO clients (client_id, parent_id, plan_id, overrides, capacity, rate_per_sec, algorithm, window_seconds,
+			shadow, on_limit, max_delay_ms, max_queued, request_bytes_per_sec, response_bytes_per_sec, tokens, last_refill, state, created_at, updated_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), COALESCE($4::text[], '{}'), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			$15, $16, $17, $18, $19)
+		RETURNING version
 	`
-	_, err := r.store.pool.Exec(ctx, query,
-		client.ClientID, client.Capacity, client.RatePerSec, client.Tokens,
-		client.LastRefill, client.CreatedAt, client.UpdatedAt)
+	err := r.store.pool.QueryRow(ctx, query,
+		client.ClientID, client.ParentID, client.PlanID, client.Overrides, client.Capacity, client.RatePerSec, client.Algorithm,
+		client.WindowSeconds, client.Shadow, client.OnLimit, client.MaxDelayMs, client.MaxQueued,
+		client.RequestBytesPerSec, client.ResponseBytesPerSec, client.Tokens, client.LastRefill, client.State,
+		client.CreatedAt, client.UpdatedAt).Scan(&client.Version)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrClientExists
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create client: %w", err)
 	}
@@ -37,14 +164,8 @@ func (r *clientRepository) Create(ctx context.Context, client *models.Client) er
 }
 
 func (r *clientRepository) GetByID(ctx context.Context, clientID string) (*models.Client, error) {
-	query := `
-		SELECT client_id, capacity, rate_per_sec, tokens, last_refill, created_at, updated_at
-		FROM clients WHERE client_id = $1
-	`
-	client := &models.Client{}
-	err := r.store.pool.QueryRow(ctx, query, clientID).Scan(
-		&client.ClientID, &client.Capacity, &client.RatePerSec, &client.Tokens,
-		&client.LastRefill, &client.CreatedAt, &client.UpdatedAt)
+	query := `SELECT ` + clientColumns + ` FROM clients WHERE client_id = $1`
+	client, err := scanClient(r.store.pool.QueryRow(ctx, query, clientID))
 	if err == pgx.ErrNoRows {
 		return nil, nil
 	}
@@ -55,13 +176,9 @@ func (r *clientRepository) GetByID(ctx context.Context, clientID string) (*model
 }
 
 func (r *clientRepository) GetByIDForUpdate(ctx context.Context, clientID string) (*models.Client, error) {
-	client := &models.Client{}
-	err := r.store.pool.QueryRow(ctx,
-		`SELECT client_id, capacity, rate_per_sec, tokens, last_refill, created_at, updated_at
-		FROM clients WHERE client_id = $1 FOR UPDATE`,
-		clientID).Scan(
-		&client.ClientID, &client.Capacity, &client.RatePerSec, &client.Tokens,
-		&client.LastRefill, &client.CreatedAt, &client.UpdatedAt)
+	client, err := scanClient(r.store.pool.QueryRow(ctx,
+		`SELECT `+clientColumns+` FROM clients WHERE client_id = $1 FOR UPDATE`,
+		clientID))
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil
@@ -72,10 +189,7 @@ func (r *clientRepository) GetByIDForUpdate(ctx context.Context, clientID string
 }
 
 func (r *clientRepository) GetAllClients(ctx context.Context) ([]*models.Client, error) {
-	query := `
-		SELECT client_id, capacity, rate_per_sec, tokens, last_refill, created_at, updated_at
-		FROM clients
-	`
+	query := `SELECT ` + clientColumns + ` FROM clients`
 	rows, err := r.store.pool.Query(ctx, query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all clients: %w", err)
@@ -84,10 +198,7 @@ func (r *clientRepository) GetAllClients(ctx context.Context) ([]*models.Client,
 
 	var clients []*models.Client
 	for rows.Next() {
-		client := &models.Client{}
-		err := rows.Scan(
-			&client.ClientID, &client.Capacity, &client.RatePerSec, &client.Tokens,
-			&client.LastRefill, &client.CreatedAt, &client.UpdatedAt)
+		client, err := scanClient(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan client: %w", err)
 		}
@@ -101,32 +212,596 @@ func (r *clientRepository) GetAllClients(ctx context.Context) ([]*models.Client,
 	return clients, nil
 }
 
-func (r *clientRepository) Update(ctx context.Context, client *models.Client) error {
+// Sort keys of List.
+const (
+	SortClientID  = "client_id"
+	SortCreatedAt = "created_at"
+	SortUpdatedAt = "updated_at"
+)
+
+// throttledCondition is true for clients that could not take cost tokens as
+// of their last request, counting what a token bucket has refilled since, or
+// whose parent or a further ancestor could not. An active temporary limit
+// stands in for the limit of its level.
+func throttledCondition(cost string) string {
+	return fmt.Sprintf(`EXISTS (
+		WITH RECURSIVE chain (client_id, parent_id, depth) AS (
+			SELECT clients.client_id, clients.parent_id, 1
+			UNION ALL
+			SELECT p.client_id, p.parent_id, chain.depth + 1
+			FROM clients p JOIN chain ON p.client_id = chain.parent_id
+			WHERE chain.depth < %d
+		)
+		SELECT 1 FROM chain JOIN clients l ON l.client_id = chain.client_id
+		WHERE CASE WHEN l.algorithm = 'token_bucket'
+			THEN LEAST(
+				l.tokens + GREATEST(EXTRACT(EPOCH FROM (now() - l.last_refill)), 0) *
+					CASE WHEN l.temp_expires_at > now() THEN l.temp_rate_per_sec ELSE l.rate_per_sec END,
+				CASE WHEN l.temp_expires_at > now() THEN l.temp_capacity ELSE l.capacity END) < %[2]s
+			ELSE l.tokens < %[2]s END
+	)`, models.MaxChainDepth, cost)
+}
+
+// cursor is the position after the last client of a page, encoded opaquely
+// for the caller.
+type cursor struct {
+	Sort     string    `json:"s"`
+	ClientID string    `json:"id"`
+	At       time.Time `json:"at,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// List returns a page of clients matching the query, ordered by the sort key
+// and then client_id, and the cursor of the next page, empty on the last one.
+// Pages are taken by keyset, so they stay consistent while clients are added
+// or removed.
+func (r *clientRepository) List(ctx context.Context, query *models.ClientQuery) ([]*models.Client, string, error) {
+	sort := query.Sort
+	if sort == "" {
+		sort = SortClientID
+	}
+	if sort != SortClientID && sort != SortCreatedAt && sort != SortUpdatedAt {
+		return nil, "", fmt.Errorf("unknown sort %s", sort)
+	}
+
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.Prefix != "" {
+		conditions = append(conditions, "starts_with(client_id, "+arg(query.Prefix)+")")
+	}
+	if query.PlanID != "" {
+		conditions = append(conditions, "plan_id = "+arg(query.PlanID))
+	}
+	if !query.CreatedFrom.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(query.CreatedFrom.UTC()))
+	}
+	if !query.CreatedTo.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(query.CreatedTo.UTC()))
+	}
+	if query.Throttled != nil {
+		throttled := throttledCondition(arg(max(query.Cost, 1)))
+		if *query.Throttled {
+			conditions = append(conditions, throttled)
+		} else {
+			conditions = append(conditions, "NOT "+throttled)
+		}
+	}
+
+	direction, compare := "ASC", ">"
+	if query.Desc {
+		direction, compare = "DESC", "<"
+	}
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil || after.Sort != sort {
+			return nil, "", ErrInvalidCursor
+		}
+		if sort == SortClientID {
+			conditions = append(conditions, "client_id "+compare+" "+arg(after.ClientID))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("(%s, client_id) %s (%s, %s)",
+				sort, compare, arg(after.At), arg(after.ClientID)))
+		}
+	}
+
+	sql := `SELECT ` + clientColumns + ` FROM clients`
+	if len(conditions) > 0 {
+		sql += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	if sort == SortClientID {
+		sql += fmt.Sprintf(` ORDER BY client_id %s`, direction)
+	} else {
+		sql += fmt.Sprintf(` ORDER BY %s %s, client_id %s`, sort, direction, direction)
+	}
+	sql += ` LIMIT ` + arg(query.Limit+1)
+
+	rows, err := r.store.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list clients: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []*models.Client{}
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan client: %w", err)
+		}
+		clients = append(clients, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error iterating clients: %w", err)
+	}
+
+	if len(clients) <= query.Limit {
+		return clients, "", nil
+	}
+	clients = clients[:query.Limit]
+	last := clients[len(clients)-1]
+	next := cursor{Sort: sort, ClientID: last.ClientID}
+	switch sort {
+	case SortCreatedAt:
+		next.At = last.CreatedAt
+	case SortUpdatedAt:
+		next.At = last.UpdatedAt
+	}
+	return clients, encodeCursor(next), nil
+}
+
+// Consume refills a token bucket client from last_refill, checks it and takes
+// cost tokens in a single statement, so concurrent requests can never spend the
+// same tokens. The returned client reflects the stored state; the bool reports
+// whether the tokens were taken. A missing client, one that uses another
+// algorithm, has a parent or delays requests over its limit yields nil, false,
+// nil.
+func (r *clientRepository) Consume(ctx context.Context, clientID string, cost int) (*models.Client, bool, error) {
+	query := `
+		WITH current AS (
+			SELECT client_id, capacity, rate_per_sec, tokens, last_refill,
+				GREATEST(EXTRACT(EPOCH FROM (now() - last_refill)), 0) * rate_per_sec AS earned
+			FROM clients WHERE client_id = $1 AND algorithm = 'token_bucket' AND parent_id IS NULL
+				AND on_limit = 'reject' AND (temp_expires_at IS NULL OR temp_expires_at <= CURRENT_TIMESTAMP)
+			FOR UPDATE
+		), refilled AS (
+			SELECT client_id,
+				CASE WHEN tokens + earned >= capacity THEN capacity
+					ELSE tokens + FLOOR(earned)::int END AS tokens,
+				CASE WHEN tokens + earned >= capacity THEN now()
+					ELSE last_refill + make_interval(secs => (FLOOR(earned) / rate_per_sec)::float8) END AS last_refill
+			FROM current
+		)
+		UPDATE clients c
+		SET tokens = CASE WHEN r.tokens >= $2 THEN r.tokens - $2 ELSE r.tokens END,
+			last_refill = r.last_refill
+		FROM refilled r
+		WHERE c.client_id = r.client_id
+		RETURNING ` + qualifiedClientColumns + `, r.tokens >= $2
+	`
+	var allowed bool
+	client, err := scanClient(r.store.pool.QueryRow(ctx, query, clientID, cost), &allowed)
+	if err == pgx.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to consume tokens for client %s: %w", clientID, err)
+	}
+	return client, allowed, nil
+}
+
+// GetChain returns a client followed by its parent, its parent's parent and
+// so on. A missing client yields an empty chain.
+func (r *clientRepository) GetChain(ctx context.Context, clientID string) ([]*models.Client, error) {
+	rows, err := r.store.pool.Query(ctx, chainQuery, clientID, models.MaxChainDepth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain of client %s: %w", clientID, err)
+	}
+	chain, err := scanChain(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chain of client %s: %w", clientID, err)
+	}
+	return chain, nil
+}
+
+// UpdateChain locks a client and all of its ancestors in a transaction and
+// passes them to fn, the client first. When fn returns true the bucket state
+// it left in every level is written back before the transaction commits;
+// otherwise nothing is written, so no level is ever debited alone. A missing
+// client yields nil, false, nil.
+func (r *clientRepository) UpdateChain(ctx context.Context, clientID string, fn func(chain []*models.Client) bool) ([]*models.Client, bool, error) {
+	tx, err := r.store.pool.Begin(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, chainQuery+` FOR UPDATE OF c`, clientID, models.MaxChainDepth)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lock chain of client %s: %w", clientID, err)
+	}
+	chain, err := scanChain(rows)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to lock chain of client %s: %w", clientID, err)
+	}
+	if len(chain) == 0 {
+		return nil, false, nil
+	}
+
+	if !fn(chain) {
+		return chain, false, nil
+	}
+
 	query := `
 		UPDATE clients
-		SET capacity = $2, rate_per_sec = $3, tokens = $4, last_refill = $5, updated_at = CURRENT_TIMESTAMP
+		SET tokens = $2, last_refill = $3, state = $4
 		WHERE client_id = $1
 		RETURNING updated_at
 	`
-	var updatedAt time.Time
+	for _, client := range chain {
+		err = tx.QueryRow(ctx, query,
+			client.ClientID, client.Tokens, client.LastRefill, client.State).Scan(&client.UpdatedAt)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to update state of client %s: %w", client.ClientID, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, fmt.Errorf("failed to commit state of client %s: %w", clientID, err)
+	}
+	return chain, true, nil
+}
+
+// SaveTokens writes the bucket state of several clients in one batch. Clients
+// deleted in the meantime are skipped, and tokens are capped at what the
+// client may hold now, its stored capacity or an unexpired temporary one, in
+// case either was lowered after the state was taken.
+func (r *clientRepository) SaveTokens(ctx context.Context, clients []*models.Client) error {
+	query := `
+		UPDATE clients
+		SET tokens = LEAST($2, GREATEST(capacity, CASE WHEN temp_expires_at > now() THEN temp_capacity ELSE 0 END)),
+			last_refill = $3, state = $4
+		WHERE client_id = $1
+	`
+	batch := &pgx.Batch{}
+	for _, client := range clients {
+		batch.Queue(query, client.ClientID, client.Tokens, client.LastRefill, client.State)
+	}
+	if err := r.store.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to save tokens of %d clients: %w", len(clients), err)
+	}
+	return nil
+}
+
+// Update saves the client's settings if its version is still client.Version
+// and sets the new one. The stored bucket state is kept, with its tokens
+// capped at the new capacity or an unexpired temporary one if larger, so
+// tokens taken since the client was read are not given back; the client's own
+// bucket state is written only when its algorithm or window changed. The
+// client is left with the stored state. It fails with ErrVersionConflict when
+// the client was changed since it was read.
+func (r *clientRepository) Update(ctx context.Context, client *models.Client) error {
+	query := `
+		UPDATE clients
+		SET parent_id = NULLIF($2, ''), plan_id = NULLIF($3, ''), overrides = COALESCE($4::text[], '{}'),
+			capacity = $5, rate_per_sec = $6, algorithm = $7, window_seconds = $8, shadow = $9, on_limit = $10,
+			max_delay_ms = $11, max_queued = $12, request_bytes_per_sec = $13, response_bytes_per_sec = $14,
+			tokens = CASE WHEN algorithm = $7 AND window_seconds = $8
+				THEN LEAST(tokens, GREATEST($5, CASE WHEN temp_expires_at > now() THEN temp_capacity ELSE 0 END)) ELSE $15 END,
+			last_refill = CASE WHEN algorithm = $7 AND window_seconds = $8 THEN last_refill ELSE $16 END,
+			state = CASE WHEN algorithm = $7 AND window_seconds = $8 THEN state ELSE $17 END,
+			updated_at = CURRENT_TIMESTAMP, version = version + 1
+		WHERE client_id = $1 AND version = $18
+		RETURNING tokens, last_refill, state, updated_at, version
+	`
+	var tokens int
+	var lastRefill, updatedAt time.Time
+	var state models.LimiterState
+	var version int64
 	err := r.store.pool.QueryRow(ctx, query,
-		client.ClientID, client.Capacity, client.RatePerSec, client.Tokens,
-		client.LastRefill).Scan(&updatedAt)
+		client.ClientID, client.ParentID, client.PlanID, client.Overrides, client.Capacity, client.RatePerSec, client.Algorithm,
+		client.WindowSeconds, client.Shadow, client.OnLimit, client.MaxDelayMs, client.MaxQueued,
+		client.RequestBytesPerSec, client.ResponseBytesPerSec, client.Tokens, client.LastRefill,
+		client.State, client.Version).Scan(&tokens, &lastRefill, &state, &updatedAt, &version)
 	if err == pgx.ErrNoRows {
+		var exists bool
+		if err := r.store.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM clients WHERE client_id = $1)`,
+			client.ClientID).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to update client %s: %w", client.ClientID, err)
+		}
+		if exists {
+			return ErrVersionConflict
+		}
 		return fmt.Errorf("client with id %s not found", client.ClientID)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to update client %s: %w", client.ClientID, err)
 	}
+	client.Tokens = tokens
+	client.LastRefill = lastRefill
+	client.State = state
 	client.UpdatedAt = updatedAt
+	client.Version = version
 	return nil
 }
 
-func (r *clientRepository) Delete(ctx context.Context, clientID string) error {
+// Delete removes a client, reporting false if it did not exist. It fails with
+// ErrClientHasChildren while other clients name it as their parent.
+func (r *clientRepository) Delete(ctx context.Context, clientID string) (bool, error) {
 	query := `DELETE FROM clients WHERE client_id = $1`
-	_, err := r.store.pool.Exec(ctx, query, clientID)
+	tag, err := r.store.pool.Exec(ctx, query, clientID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return false, ErrClientHasChildren
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to delete client %s: %w", clientID, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Conflict modes of Import: fail aborts the import on an existing client,
+// skip leaves it as it is and upsert overwrites its settings.
+const (
+	ImportFail   = "fail"
+	ImportSkip   = "skip"
+	ImportUpsert = "upsert"
+)
+
+// Outcomes of the clients passed to Import.
+const (
+	ImportCreated = "created"
+	ImportUpdated = "updated"
+	ImportSkipped = "skipped"
+)
+
+// ImportError reports the client that made Import fail. Field names the
+// client field at fault, if known.
+type ImportError struct {
+	Index int
+	Field string
+	Err   error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("client %d: %v", e.Index, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// Import writes clients in one transaction, sending them in a single batch,
+// and returns the outcome of each. Parents must come before their children.
+// An updated client keeps its tokens, capped at the new capacity, unless its
+// algorithm or window changed. Nothing is written when any client fails,
+// which is reported as an *ImportError.
+func (r *clientRepository) Import(ctx context.Context, clients []*models.Client, mode string) ([]string, error) {
+	query := `
+		INSERT INTO clients (client_id, parent_id, plan_id, overrides, capacity, rate_per_sec, algorithm, window_seconds,
+			shadow, on_limit, max_delay_ms, max_queued, request_bytes_per_sec, response_bytes_per_sec, tokens, last_refill, state, created_at, updated_at)
+		VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), COALESCE($4::text[], '{}'), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			$15, $16, $17, $18, $19)
+	`
+	switch mode {
+	case ImportSkip:
+		query += ` ON CONFLICT (client_id) DO NOTHING`
+	case ImportUpsert:
+		query += `
+		ON CONFLICT (client_id) DO UPDATE SET parent_id = EXCLUDED.parent_id, plan_id = EXCLUDED.plan_id,
+			overrides = EXCLUDED.overrides, capacity = EXCLUDED.capacity, rate_per_sec = EXCLUDED.rate_per_sec,
+			algorithm = EXCLUDED.algorithm, window_seconds = EXCLUDED.window_seconds, shadow = EXCLUDED.shadow,
+			on_limit = EXCLUDED.on_limit, max_delay_ms = EXCLUDED.max_delay_ms, max_queued = EXCLUDED.max_queued,
+			request_bytes_per_sec = EXCLUDED.request_bytes_per_sec, response_bytes_per_sec = EXCLUDED.response_bytes_per_sec,
+			tokens = CASE WHEN clients.algorithm = EXCLUDED.algorithm AND clients.window_seconds = EXCLUDED.window_seconds
+				THEN LEAST(clients.tokens, GREATEST(EXCLUDED.capacity,
+					CASE WHEN clients.temp_expires_at > now() THEN clients.temp_capacity ELSE 0 END))
+				ELSE EXCLUDED.tokens END,
+			last_refill = CASE WHEN clients.algorithm = EXCLUDED.algorithm AND clients.window_seconds = EXCLUDED.window_seconds
+				THEN clients.last_refill ELSE EXCLUDED.last_refill END,
+			state = CASE WHEN clients.algorithm = EXCLUDED.algorithm AND clients.window_seconds = EXCLUDED.window_seconds
+				THEN clients.state ELSE '{}' END,
+			updated_at = CURRENT_TIMESTAMP, version = clients.version + 1`
+	}
+	query += `
+		RETURNING ` + clientColumns + `, xmax = 0`
+
+	tx, err := r.store.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to delete client %s: %w", clientID, err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	for _, client := range clients {
+		batch.Queue(query,
+			client.ClientID, client.ParentID, client.PlanID, client.Overrides, client.Capacity, client.RatePerSec, client.Algorithm,
+			client.WindowSeconds, client.Shadow, client.OnLimit, client.MaxDelayMs, client.MaxQueued,
+			client.RequestBytesPerSec, client.ResponseBytesPerSec, client.Tokens, client.LastRefill, client.State,
+			client.CreatedAt, client.UpdatedAt)
+	}
+	results := tx.SendBatch(ctx, batch)
+	outcomes := make([]string, len(clients))
+	for i, client := range clients {
+		var inserted bool
+		saved, err := scanClient(results.QueryRow(), &inserted)
+		switch {
+		case err == pgx.ErrNoRows:
+			outcomes[i] = ImportSkipped
+			continue
+		case err != nil:
+			results.Close()
+			return nil, importError(i, err)
+		case inserted:
+			outcomes[i] = ImportCreated
+		default:
+			outcomes[i] = ImportUpdated
+		}
+		*client = *saved
+	}
+	if err := results.Close(); err != nil {
+		return nil, fmt.Errorf("failed to import clients: %w", err)
+	}
+
+	ids := make([]string, 0, len(clients))
+	for i, client := range clients {
+		if client.ParentID != "" && outcomes[i] != ImportSkipped {
+			ids = append(ids, client.ClientID)
+		}
+	}
+	if len(ids) > 0 {
+		bad, err := invalidHierarchy(ctx, tx, ids)
+		if err != nil {
+			return nil, err
+		}
+		if bad != "" {
+			i := slices.IndexFunc(clients, func(c *models.Client) bool { return c.ClientID == bad })
+			return nil, &ImportError{Index: i, Field: "parent_id", Err: ErrInvalidHierarchy}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit import: %w", err)
+	}
+	return outcomes, nil
+}
+
+// importError describes why the client at index i could not be written.
+func importError(i int, err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "23505":
+			return &ImportError{Index: i, Field: "client_id", Err: ErrClientExists}
+		case "23503":
+			field := "plan_id"
+			if pgErr.ConstraintName == "clients_parent_id_fkey" {
+				field = "parent_id"
+			}
+			return &ImportError{Index: i, Field: field, Err: ErrUnknownReference}
+		}
+	}
+	return fmt.Errorf("failed to import client %d: %w", i, err)
+}
+
+// invalidHierarchy returns one of the clients whose parent chain loops back
+// to it or is longer than models.MaxChainDepth, or "" if there is none.
+func invalidHierarchy(ctx context.Context, tx pgx.Tx, clientIDs []string) (string, error) {
+	query := `
+		WITH RECURSIVE up AS (
+			SELECT client_id AS start, client_id, parent_id, 1 AS depth FROM clients WHERE client_id = ANY($1)
+			UNION ALL
+			SELECT up.start, c.client_id, c.parent_id, up.depth + 1
+			FROM clients c JOIN up ON c.client_id = up.parent_id
+			WHERE up.depth <= $2 AND c.client_id <> up.start
+		)
+		SELECT start FROM up
+		GROUP BY start
+		HAVING MAX(depth) > $2 OR bool_or(parent_id = start)
+		LIMIT 1
+	`
+	var start string
+	err := tx.QueryRow(ctx, query, clientIDs, models.MaxChainDepth).Scan(&start)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check client hierarchy: %w", err)
+	}
+	return start, nil
+}
+
+// Export calls fn for every client, parents before their children and
+// otherwise by client_id, stopping at the first error.
+func (r *clientRepository) Export(ctx context.Context, fn func(client *models.Client) error) error {
+	query := `
+		WITH RECURSIVE tree AS (
+			SELECT client_id, 0 AS depth FROM clients WHERE parent_id IS NULL
+			UNION ALL
+			SELECT c.client_id, tree.depth + 1
+			FROM clients c JOIN tree ON c.parent_id = tree.client_id
+			WHERE tree.depth + 1 < $1
+		)
+		SELECT ` + qualifiedClientColumns + `
+		FROM clients c LEFT JOIN tree ON tree.client_id = c.client_id
+		ORDER BY COALESCE(tree.depth, $1), c.client_id
+	`
+	rows, err := r.store.pool.Query(ctx, query, models.MaxChainDepth)
+	if err != nil {
+		return fmt.Errorf("failed to export clients: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan client: %w", err)
+		}
+		if err := fn(client); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to export clients: %w", err)
 	}
 	return nil
 }
+
+// SetTemporaryLimit sets or, with a nil limit, clears a client's temporary
+// limit if the client's version is still version. Tokens above what the
+// client may now hold are dropped. A missing client yields nil, nil and a
+// client changed since it was read ErrVersionConflict.
+func (r *clientRepository) SetTemporaryLimit(ctx context.Context, clientID string, version int64, limit *models.TemporaryLimit) (*models.Client, error) {
+	query := `
+		UPDATE clients
+		SET temp_capacity = $2, temp_rate_per_sec = $3, temp_expires_at = $4, temp_applied_by = $5, temp_applied_at = $6,
+			temp_reason = NULLIF($7, ''),
+			tokens = LEAST(tokens, GREATEST(capacity, COALESCE($2, 0))),
+			updated_at = CURRENT_TIMESTAMP, version = version + 1
+		WHERE client_id = $1 AND version = $8
+		RETURNING ` + clientColumns
+	var capacity, rate *int
+	var expiresAt, appliedAt *time.Time
+	var appliedBy *string
+	var reason string
+	if limit != nil {
+		capacity, rate = &limit.Capacity, &limit.RatePerSec
+		expiresAt, appliedAt = &limit.ExpiresAt, &limit.AppliedAt
+		appliedBy, reason = &limit.AppliedBy, limit.Reason
+	}
+	client, err := scanClient(r.store.pool.QueryRow(ctx, query, clientID, capacity, rate, expiresAt, appliedBy, appliedAt, reason, version))
+	if err == pgx.ErrNoRows {
+		var exists bool
+		if err := r.store.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM clients WHERE client_id = $1)`,
+			clientID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to set temporary limit of client %s: %w", clientID, err)
+		}
+		if exists {
+			return nil, ErrVersionConflict
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to set temporary limit of client %s: %w", clientID, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dorik33/cloud/internal/config"
+	"github.com/dorik33/cloud/internal/models"
+)
+
+// testStore connects to the migrated database in TEST_DB_CONN_STR and skips
+// the test when it is not set.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	connStr := os.Getenv("TEST_DB_CONN_STR")
+	if connStr == "" {
+		t.Skip("TEST_DB_CONN_STR is not set")
+	}
+	store, err := NewConnection(&config.Config{DBConnStr: connStr})
+	if err != nil {
+		t.Fatalf("NewConnection: %v", err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestConsumeConcurrent(t *testing.T) {
+	const (
+		capacity = 20
+		requests = 200
+	)
+	store := testStore(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	client := &models.Client{
+		ClientID:      fmt.Sprintf("test-consume-%d", now.UnixNano()),
+		Capacity:      capacity,
+		RatePerSec:    1,
+		Algorithm:     "token_bucket",
+		WindowSeconds: 60,
+		OnLimit:       "reject",
+		Tokens:        capacity,
+		LastRefill:    now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := store.ClientRepository.Create(ctx, client); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	t.Cleanup(func() { store.ClientRepository.Delete(context.Background(), client.ClientID) })
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, ok, err := store.ClientRepository.Consume(ctx, client.ClientID, 1)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if got == nil {
+				errs <- fmt.Errorf("client %s not found", client.ClientID)
+				return
+			}
+			if got.Tokens < 0 {
+				errs <- fmt.Errorf("tokens went below 0: %d", got.Tokens)
+			}
+			if ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// The bucket refills one token per second, so a slow run may take one more
+	// per second it lasted.
+	elapsed := time.Since(now)
+	if got := allowed.Load(); got < capacity || got > capacity+int64(elapsed/time.Second) {
+		t.Errorf("allowed %d requests in %s, want %d", got, elapsed, capacity)
+	}
+
+	stored, err := store.ClientRepository.GetByID(ctx, client.ClientID)
+	if err != nil {
+		t.Fatalf("GetByID: %v", err)
+	}
+	if stored.Tokens < 0 {
+		t.Errorf("stored tokens = %d, want >= 0", stored.Tokens)
+	}
+}
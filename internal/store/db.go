@@ -9,9 +9,16 @@ import (
 )
 
 type Store struct {
-	pool             *pgxpool.Pool
-	config           *config.Config
-	ClientRepository ClientRepository
+	pool                  *pgxpool.Pool
+	config                *config.Config
+	ClientRepository      ClientRepository
+	ACLRepository         ACLRepository
+	QuotaRepository       QuotaRepository
+	PlanRepository        PlanRepository
+	ShadowRepository      ShadowRepository
+	UsageRepository       UsageRepository
+	IdempotencyRepository IdempotencyRepository
+	AdminTokenRepository  AdminTokenRepository
 }
 
 func NewConnection(cfg *config.Config) (*Store, error) {
@@ -31,6 +38,13 @@ func NewConnection(cfg *config.Config) (*Store, error) {
 	}
 
 	store.ClientRepository = &clientRepository{store: store}
+	store.ACLRepository = &aclRepository{store: store}
+	store.QuotaRepository = &quotaRepository{store: store}
+	store.PlanRepository = &planRepository{store: store}
+	store.ShadowRepository = &shadowRepository{store: store}
+	store.UsageRepository = &usageRepository{store: store}
+	store.IdempotencyRepository = &idempotencyRepository{store: store}
+	store.AdminTokenRepository = &adminTokenRepository{store: store}
 
 	return store, nil
 }
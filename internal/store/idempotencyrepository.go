@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+// IdempotencyRepository stores responses by idempotency key. Keys are unique
+// within a scope, the caller that chose them.
+type IdempotencyRepository interface {
+	Claim(ctx context.Context, scope, key, requestHash string, expiresAt, staleBefore time.Time) (*models.IdempotentResponse, error)
+	Complete(ctx context.Context, scope, key string, status int, headers map[string]string, body []byte) error
+	Release(ctx context.Context, scope, key string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type idempotencyRepository struct {
+	store *Store
+}
+
+// Claim records that a request with the key is being handled and returns nil.
+// When the key is already taken it returns the stored record instead. Expired
+// keys and keys whose request started before staleBefore without finishing
+// are taken over.
+func (r *idempotencyRepository) Claim(ctx context.Context, scope, key, requestHash string, expiresAt, staleBefore time.Time) (*models.IdempotentResponse, error) {
+	query := `
+		INSERT INTO idempotency_keys (key, request_hash, expires_at, scope)
+		VALUES ($1, $2, $3, $5)
+		ON CONFLICT (scope, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status = NULL, headers = '{}',
+			body = NULL, created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= CURRENT_TIMESTAMP
+			OR (idempotency_keys.status IS NULL AND idempotency_keys.created_at < $4)
+		RETURNING key
+	`
+	var claimed string
+	err := r.store.pool.QueryRow(ctx, query, key, requestHash, expiresAt, staleBefore, scope).Scan(&claimed)
+	if err == nil {
+		return nil, nil
+	}
+	if err != pgx.ErrNoRows {
+		return nil, fmt.Errorf("failed to claim idempotency key %s: %w", key, err)
+	}
+
+	query = `
+		SELECT key, request_hash, COALESCE(status, 0), headers, body, created_at, expires_at
+		FROM idempotency_keys WHERE scope = $1 AND key = $2
+	`
+	response := &models.IdempotentResponse{}
+	err = r.store.pool.QueryRow(ctx, query, scope, key).Scan(
+		&response.Key, &response.RequestHash, &response.Status, &response.Headers, &response.Body,
+		&response.CreatedAt, &response.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key %s: %w", key, err)
+	}
+	return response, nil
+}
+
+// Complete stores the response to the request that claimed the key.
+func (r *idempotencyRepository) Complete(ctx context.Context, scope, key string, status int, headers map[string]string, body []byte) error {
+	query := `UPDATE idempotency_keys SET status = $3, headers = $4, body = $5 WHERE scope = $1 AND key = $2`
+	if _, err := r.store.pool.Exec(ctx, query, scope, key, status, headers, body); err != nil {
+		return fmt.Errorf("failed to store response for idempotency key %s: %w", key, err)
+	}
+	return nil
+}
+
+// Release forgets a key whose request failed, so that a retry runs again.
+func (r *idempotencyRepository) Release(ctx context.Context, scope, key string) error {
+	if _, err := r.store.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key); err != nil {
+		return fmt.Errorf("failed to release idempotency key %s: %w", key, err)
+	}
+	return nil
+}
+
+func (r *idempotencyRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	tag, err := r.store.pool.Exec(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrPlanNotFound = errors.New("plan not found")
+	ErrPlanInUse    = errors.New("plan is referenced by clients")
+	ErrPlanExists   = errors.New("plan already exists")
+)
+
+type PlanRepository interface {
+	Create(ctx context.Context, plan *models.Plan) error
+	GetByID(ctx context.Context, planID string) (*models.Plan, error)
+	GetAll(ctx context.Context) ([]*models.Plan, error)
+	Update(ctx context.Context, plan *models.Plan) ([]*models.Client, error)
+	Delete(ctx context.Context, planID string) (bool, error)
+}
+
+const planColumns = `plan_id, capacity, rate_per_sec, algorithm, window_seconds, created_at, updated_at`
+
+func scanPlan(row pgx.Row) (*models.Plan, error) {
+	plan := &models.Plan{}
+	err := row.Scan(&plan.PlanID, &plan.Capacity, &plan.RatePerSec, &plan.Algorithm, &plan.WindowSeconds,
+		&plan.CreatedAt, &plan.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+type planRepository struct {
+	store *Store
+}
+
+func (r *planRepository) Create(ctx context.Context, plan *models.Plan) error {
+	query := `
+		INSERT INTO plans (plan_id, capacity, rate_per_sec, algorithm, window_seconds)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at, updated_at
+	`
+	err := r.store.pool.QueryRow(ctx, query,
+		plan.PlanID, plan.Capacity, plan.RatePerSec, plan.Algorithm, plan.WindowSeconds).Scan(
+		&plan.CreatedAt, &plan.UpdatedAt)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return ErrPlanExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create plan: %w", err)
+	}
+	return nil
+}
+
+func (r *planRepository) GetByID(ctx context.Context, planID string) (*models.Plan, error) {
+	query := `SELECT ` + planColumns + ` FROM plans WHERE plan_id = $1`
+	plan, err := scanPlan(r.store.pool.QueryRow(ctx, query, planID))
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plan %s: %w", planID, err)
+	}
+	return plan, nil
+}
+
+func (r *planRepository) GetAll(ctx context.Context) ([]*models.Plan, error) {
+	query := `SELECT ` + planColumns + ` FROM plans ORDER BY plan_id`
+	rows, err := r.store.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get all plans: %w", err)
+	}
+	defer rows.Close()
+
+	plans := []*models.Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan plan: %w", err)
+		}
+		plans = append(plans, plan)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating plans: %w", err)
+	}
+
+	return plans, nil
+}
+
+// Update changes the plan and, in the same transaction, every field of its
+// clients that they do not override. Clients whose algorithm or window
+// changes start with a fresh limiter: a full bucket, refilled from now, and
+// an empty state. The updated clients are returned, or ErrPlanNotFound.
+func (r *planRepository) Update(ctx context.Context, plan *models.Plan) ([]*models.Client, error) {
+	tx, err := r.store.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `
+		UPDATE plans
+		SET capacity = $2, rate_per_sec = $3, algorithm = $4, window_seconds = $5
+		WHERE plan_id = $1
+		RETURNING created_at, updated_at
+	`
+	err = tx.QueryRow(ctx, query,
+		plan.PlanID, plan.Capacity, plan.RatePerSec, plan.Algorithm, plan.WindowSeconds).Scan(
+		&plan.CreatedAt, &plan.UpdatedAt)
+	if err == pgx.ErrNoRows {
+		return nil, ErrPlanNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update plan %s: %w", plan.PlanID, err)
+	}
+
+	query = `
+		UPDATE clients c
+		SET capacity = n.capacity, rate_per_sec = n.rate_per_sec,
+			algorithm = n.algorithm, window_seconds = n.window_seconds,
+			tokens = CASE WHEN n.algorithm = c.algorithm AND n.window_seconds = c.window_seconds
+				THEN LEAST(c.tokens, GREATEST(n.capacity, CASE WHEN c.temp_expires_at > now() THEN c.temp_capacity ELSE 0 END))
+				ELSE n.capacity END,
+			last_refill = CASE WHEN n.algorithm = c.algorithm AND n.window_seconds = c.window_seconds
+				THEN c.last_refill ELSE now() END,
+			state = CASE WHEN n.algorithm = c.algorithm AND n.window_seconds = c.window_seconds
+				THEN c.state ELSE '{}' END,
+			version = c.version + 1
+		FROM (
+			SELECT client_id,
+				CASE WHEN 'capacity' = ANY(overrides) THEN capacity ELSE $2 END AS capacity,
+				CASE WHEN 'rate_per_sec' = ANY(overrides) THEN rate_per_sec ELSE $3 END AS rate_per_sec,
+				CASE WHEN 'algorithm' = ANY(overrides) THEN algorithm ELSE $4 END AS algorithm,
+				CASE WHEN 'window_seconds' = ANY(overrides) THEN window_seconds ELSE $5 END AS window_seconds
+			FROM clients WHERE plan_id = $1
+		) n
+		WHERE c.client_id = n.client_id
+		RETURNING ` + qualifiedClientColumns + `
+	`
+	rows, err := tx.Query(ctx, query,
+		plan.PlanID, plan.Capacity, plan.RatePerSec, plan.Algorithm, plan.WindowSeconds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply plan %s to clients: %w", plan.PlanID, err)
+	}
+	clients := []*models.Client{}
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan client: %w", err)
+		}
+		clients = append(clients, client)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to apply plan %s to clients: %w", plan.PlanID, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit plan %s: %w", plan.PlanID, err)
+	}
+	return clients, nil
+}
+
+// Delete removes a plan. It fails with ErrPlanInUse while clients reference
+// it.
+func (r *planRepository) Delete(ctx context.Context, planID string) (bool, error) {
+	query := `DELETE FROM plans WHERE plan_id = $1`
+	tag, err := r.store.pool.Exec(ctx, query, planID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+		return false, ErrPlanInUse
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to delete plan %s: %w", planID, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dorik33/cloud/internal/models"
+)
+
+type QuotaRepository interface {
+	GetByClient(ctx context.Context, clientID string) ([]*models.Quota, error)
+	Set(ctx context.Context, quota *models.Quota) error
+	Delete(ctx context.Context, clientID, period string) (bool, error)
+	Consume(ctx context.Context, clientID string, n int64) ([]*models.Quota, bool, error)
+	Refund(ctx context.Context, clientID string, n int64) error
+}
+
+// currentQuotaColumns reports quotas as of the current period: a quota whose
+// stored period has ended shows nothing used yet.
+const currentQuotaColumns = `client_id, period, quota_limit, timezone,
+	CASE WHEN period_start < date_trunc(period, now(), timezone) THEN 0 ELSE used END AS used,
+	date_trunc(period, now(), timezone) AS period_start,
+	(date_trunc(period, now(), timezone) AT TIME ZONE timezone + ('1 ' || period)::interval) AT TIME ZONE timezone AS resets_at`
+
+type quotaRepository struct {
+	store *Store
+}
+
+func (r *quotaRepository) GetByClient(ctx context.Context, clientID string) ([]*models.Quota, error) {
+	query := `SELECT ` + currentQuotaColumns + ` FROM client_quotas WHERE client_id = $1 ORDER BY period`
+	rows, err := r.store.pool.Query(ctx, query, clientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get quotas of client %s: %w", clientID, err)
+	}
+	defer rows.Close()
+
+	quotas := []*models.Quota{}
+	for rows.Next() {
+		quota := &models.Quota{}
+		err := rows.Scan(&quota.ClientID, &quota.Period, &quota.Limit, &quota.Timezone,
+			&quota.Used, &quota.PeriodStart, &quota.ResetsAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan quota: %w", err)
+		}
+		quotas = append(quotas, quota)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating quotas: %w", err)
+	}
+
+	return quotas, nil
+}
+
+// Set creates the client's quota for the period or changes its limit and
+// timezone, keeping what was already used.
+func (r *quotaRepository) Set(ctx context.Context, quota *models.Quota) error {
+	query := `
+		WITH upserted AS (
+			INSERT INTO client_quotas (client_id, period, quota_limit, timezone)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (client_id, period) DO UPDATE
+			SET quota_limit = EXCLUDED.quota_limit, timezone = EXCLUDED.timezone
+			RETURNING *
+		)
+		SELECT ` + currentQuotaColumns + ` FROM upserted
+	`
+	err := r.store.pool.QueryRow(ctx, query,
+		quota.ClientID, quota.Period, quota.Limit, quota.Timezone).Scan(
+		&quota.ClientID, &quota.Period, &quota.Limit, &quota.Timezone,
+		&quota.Used, &quota.PeriodStart, &quota.ResetsAt)
+	if err != nil {
+		return fmt.Errorf("failed to set %s quota of client %s: %w", quota.Period, quota.ClientID, err)
+	}
+	return nil
+}
+
+func (r *quotaRepository) Delete(ctx context.Context, clientID, period string) (bool, error) {
+	query := `DELETE FROM client_quotas WHERE client_id = $1 AND period = $2`
+	tag, err := r.store.pool.Exec(ctx, query, clientID, period)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete %s quota of client %s: %w", period, clientID, err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// Consume counts n requests against every quota of the client in a single
+// statement. Either all quotas have room and are charged, or none is. The
+// returned quotas reflect the outcome; a client without quotas is allowed.
+func (r *quotaRepository) Consume(ctx context.Context, clientID string, n int64) ([]*models.Quota, bool, error) {
+	query := `
+		WITH current AS (
+			SELECT ` + currentQuotaColumns + `
+			FROM client_quotas WHERE client_id = $1
+			FOR UPDATE
+		), verdict AS (
+			SELECT COALESCE(bool_and(used + $2 <= quota_limit), true) AS allowed FROM current
+		), updated AS (
+			UPDATE client_quotas q
+			SET used = c.used + $2, period_start = c.period_start
+			FROM current c, verdict v
+			WHERE v.allowed AND q.client_id = c.client_id AND q.period = c.period
+		)
+		SELECT c.client_id, c.period, c.quota_limit, c.timezone,
+			c.used + CASE WHEN v.allowed THEN $2 ELSE 0 END, c.period_start, c.resets_at, v.allowed
+		FROM current c, verdict v
+		ORDER BY c.period
+	`
+	rows, err := r.store.pool.Query(ctx, query, clientID, n)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to consume quotas of client %s: %w", clientID, err)
+	}
+
+	defer rows.Close()
+
+	allowed := true
+	quotas := []*models.Quota{}
+	for rows.Next() {
+		quota := &models.Quota{}
+		err := rows.Scan(&quota.ClientID, &quota.Period, &quota.Limit, &quota.Timezone,
+			&quota.Used, &quota.PeriodStart, &quota.ResetsAt, &allowed)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to scan quota: %w", err)
+		}
+		quotas = append(quotas, quota)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("failed to consume quotas of client %s: %w", clientID, err)
+	}
+
+	return quotas, allowed, nil
+}
+
+// Refund gives back n requests counted by Consume. Quotas whose period has
+// ended since are left alone, as their count has started over.
+func (r *quotaRepository) Refund(ctx context.Context, clientID string, n int64) error {
+	query := `
+		UPDATE client_quotas
+		SET used = GREATEST(used - $2, 0)
+		WHERE client_id = $1 AND period_start >= date_trunc(period, now(), timezone)
+	`
+	if _, err := r.store.pool.Exec(ctx, query, clientID, n); err != nil {
+		return fmt.Errorf("failed to refund quotas of client %s: %w", clientID, err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+type ShadowRepository interface {
+	Record(ctx context.Context, denials []*models.ShadowDenial) error
+	Report(ctx context.Context, from, to time.Time) ([]*models.ShadowReport, error)
+}
+
+type shadowRepository struct {
+	store *Store
+}
+
+// Record adds per-minute shadow denial counts in one batch. Counts of clients
+// deleted in the meantime are dropped.
+func (r *shadowRepository) Record(ctx context.Context, denials []*models.ShadowDenial) error {
+	query := `
+		INSERT INTO shadow_denials (client_id, minute, denials)
+		SELECT client_id, $2, $3 FROM clients WHERE client_id = $1
+		ON CONFLICT (client_id, minute) DO UPDATE SET denials = shadow_denials.denials + EXCLUDED.denials
+	`
+	batch := &pgx.Batch{}
+	for _, denial := range denials {
+		batch.Queue(query, denial.ClientID, denial.Minute, denial.Denials)
+	}
+	if err := r.store.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to record %d shadow denial counts: %w", len(denials), err)
+	}
+	return nil
+}
+
+// Report sums the shadow denials of every affected client in the minutes
+// from from up to to, most denied first.
+func (r *shadowRepository) Report(ctx context.Context, from, to time.Time) ([]*models.ShadowReport, error) {
+	query := `
+		SELECT client_id, SUM(denials)::bigint, MIN(minute), MAX(minute)
+		FROM shadow_denials
+		WHERE minute >= date_trunc('minute', $1::timestamptz) AND minute < $2
+		GROUP BY client_id
+		ORDER BY 2 DESC, client_id
+	`
+	rows, err := r.store.pool.Query(ctx, query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shadow denials: %w", err)
+	}
+	defer rows.Close()
+
+	reports := []*models.ShadowReport{}
+	for rows.Next() {
+		report := &models.ShadowReport{}
+		if err := rows.Scan(&report.ClientID, &report.Denials, &report.FirstSeen, &report.LastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan shadow denials: %w", err)
+		}
+		reports = append(reports, report)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating shadow denials: %w", err)
+	}
+
+	return reports, nil
+}
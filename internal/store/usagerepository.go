@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/jackc/pgx/v5"
+)
+
+type UsageRepository interface {
+	Add(ctx context.Context, usage []*models.Usage) error
+	Get(ctx context.Context, clientID, granularity string, from, to time.Time) ([]*models.Usage, error)
+}
+
+type usageRepository struct {
+	store *Store
+}
+
+// Add adds per-minute usage to the stored minute and hour totals in one
+// batch. Usage of clients deleted in the meantime is dropped.
+func (r *usageRepository) Add(ctx context.Context, usage []*models.Usage) error {
+	query := `
+		INSERT INTO client_usage (client_id, granularity, bucket_start, allowed, rejected, bytes_in, bytes_out,
+			status_2xx, status_3xx, status_4xx, status_5xx)
+		SELECT client_id, $2, date_trunc($2, $3::timestamptz), $4, $5, $6, $7, $8, $9, $10, $11
+		FROM clients WHERE client_id = $1
+		ON CONFLICT (client_id, granularity, bucket_start) DO UPDATE
+		SET allowed = client_usage.allowed + EXCLUDED.allowed,
+			rejected = client_usage.rejected + EXCLUDED.rejected,
+			bytes_in = client_usage.bytes_in + EXCLUDED.bytes_in,
+			bytes_out = client_usage.bytes_out + EXCLUDED.bytes_out,
+			status_2xx = client_usage.status_2xx + EXCLUDED.status_2xx,
+			status_3xx = client_usage.status_3xx + EXCLUDED.status_3xx,
+			status_4xx = client_usage.status_4xx + EXCLUDED.status_4xx,
+			status_5xx = client_usage.status_5xx + EXCLUDED.status_5xx
+	`
+	batch := &pgx.Batch{}
+	for _, u := range usage {
+		for _, granularity := range []string{models.GranularityMinute, models.GranularityHour} {
+			batch.Queue(query, u.ClientID, granularity, u.Start, u.Allowed, u.Rejected, u.BytesIn, u.BytesOut,
+				u.Status2xx, u.Status3xx, u.Status4xx, u.Status5xx)
+		}
+	}
+	if err := r.store.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to add usage of %d client minutes: %w", len(usage), err)
+	}
+	return nil
+}
+
+// Get returns the buckets of the given granularity that start from from up to
+// to, ordered by client and time. An empty clientID returns every client.
+func (r *usageRepository) Get(ctx context.Context, clientID, granularity string, from, to time.Time) ([]*models.Usage, error) {
+	query := `
+		SELECT client_id, granularity, bucket_start, allowed, rejected, bytes_in, bytes_out,
+			status_2xx, status_3xx, status_4xx, status_5xx
+		FROM client_usage
+		WHERE ($1 = '' OR client_id = $1) AND granularity = $2
+			AND bucket_start >= date_trunc($2, $3::timestamptz) AND bucket_start < $4
+		ORDER BY client_id, bucket_start
+	`
+	rows, err := r.store.pool.Query(ctx, query, clientID, granularity, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get usage: %w", err)
+	}
+	defer rows.Close()
+
+	usage := []*models.Usage{}
+	for rows.Next() {
+		u := &models.Usage{}
+		err := rows.Scan(&u.ClientID, &u.Granularity, &u.Start, &u.Allowed, &u.Rejected, &u.BytesIn, &u.BytesOut,
+			&u.Status2xx, &u.Status3xx, &u.Status4xx, &u.Status5xx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+		usage = append(usage, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating usage: %w", err)
+	}
+
+	return usage, nil
+}
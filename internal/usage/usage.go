@@ -0,0 +1,153 @@
+package usage
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/dorik33/cloud/internal/models"
+	"github.com/dorik33/cloud/internal/store"
+)
+
+type key struct {
+	clientID string
+	minute   time.Time
+}
+
+// Recorder counts client usage per minute in process and adds it to the
+// minute and hour buckets of the client_usage table every flushInterval.
+type Recorder struct {
+	repo          store.UsageRepository
+	flushInterval time.Duration
+
+	mux     sync.Mutex
+	minutes map[key]*models.Usage
+
+	done chan struct{}
+}
+
+func NewRecorder(repo store.UsageRepository, flushInterval time.Duration) *Recorder {
+	return &Recorder{
+		repo:          repo,
+		flushInterval: flushInterval,
+		minutes:       make(map[key]*models.Usage),
+	}
+}
+
+// Start flushes the recorded usage periodically until ctx is done.
+func (r *Recorder) Start(ctx context.Context) {
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.flush(ctx); err != nil {
+					slog.Error("Failed to flush usage", "error", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	slog.Info("Usage recording started", "interval", r.flushInterval)
+}
+
+// Close waits for the flush loop to stop and writes what is left.
+func (r *Recorder) Close(ctx context.Context) error {
+	if r.done != nil {
+		<-r.done
+	}
+	return r.flush(ctx)
+}
+
+// Record counts a request that the client's limits let through or rejected.
+func (r *Recorder) Record(clientID string, allowed bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	u := r.minute(clientID, time.Now())
+	if allowed {
+		u.Allowed++
+	} else {
+		u.Rejected++
+	}
+}
+
+// AddResponse counts the status class of a proxied response and the body
+// bytes the client sent and received.
+func (r *Recorder) AddResponse(clientID string, status int, in, out int64) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	u := r.minute(clientID, time.Now())
+	switch status / 100 {
+	case 2:
+		u.Status2xx++
+	case 3:
+		u.Status3xx++
+	case 4:
+		u.Status4xx++
+	case 5:
+		u.Status5xx++
+	}
+	u.BytesIn += in
+	u.BytesOut += out
+}
+
+// minute returns the usage of the client in the minute of now. The caller
+// must hold r.mux.
+func (r *Recorder) minute(clientID string, now time.Time) *models.Usage {
+	k := key{clientID: clientID, minute: now.UTC().Truncate(time.Minute)}
+	u, ok := r.minutes[k]
+	if !ok {
+		u = &models.Usage{ClientID: clientID, Granularity: models.GranularityMinute, Start: k.minute}
+		r.minutes[k] = u
+	}
+	return u
+}
+
+func (r *Recorder) flush(ctx context.Context) error {
+	r.mux.Lock()
+	if len(r.minutes) == 0 {
+		r.mux.Unlock()
+		return nil
+	}
+	minutes := r.minutes
+	r.minutes = make(map[key]*models.Usage)
+	r.mux.Unlock()
+
+	usage := make([]*models.Usage, 0, len(minutes))
+	for _, u := range minutes {
+		usage = append(usage, u)
+	}
+	if err := r.repo.Add(ctx, usage); err != nil {
+		r.mux.Lock()
+		for k, u := range minutes {
+			if current, ok := r.minutes[k]; ok {
+				merge(current, u)
+			} else {
+				r.minutes[k] = u
+			}
+		}
+		r.mux.Unlock()
+		return err
+	}
+
+	slog.Debug("Usage flushed", "minutes", len(usage))
+	return nil
+}
+
+func merge(dst, src *models.Usage) {
+	dst.Allowed += src.Allowed
+	dst.Rejected += src.Rejected
+	dst.BytesIn += src.BytesIn
+	dst.BytesOut += src.BytesOut
+	dst.Status2xx += src.Status2xx
+	dst.Status3xx += src.Status3xx
+	dst.Status4xx += src.Status4xx
+	dst.Status5xx += src.Status5xx
+}
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE acl_rules (
+    id BIGSERIAL PRIMARY KEY,
+    action VARCHAR(8) NOT NULL CHECK (action IN ('allow', 'deny')),
+    cidr CIDR NOT NULL,
+    route VARCHAR(255),
+    client_id VARCHAR(255) REFERENCES clients (client_id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (client_id IS NULL OR (action = 'allow' AND route IS NULL))
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX acl_rules_client_id_idx ON acl_rules (client_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS acl_rules;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients
+    ADD COLUMN algorithm VARCHAR(32) NOT NULL DEFAULT 'token_bucket'
+        CHECK (algorithm IN ('token_bucket', 'fixed_window', 'sliding_window', 'sliding_log', 'gcra', 'leaky_bucket')),
+    ADD COLUMN window_seconds INTEGER NOT NULL DEFAULT 60 CHECK (window_seconds > 0),
+    ADD COLUMN state JSONB NOT NULL DEFAULT '{}';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP COLUMN IF EXISTS state,
+    DROP COLUMN IF EXISTS window_seconds,
+    DROP COLUMN IF EXISTS algorithm;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE client_quotas (
+    client_id VARCHAR(255) NOT NULL REFERENCES clients (client_id) ON DELETE CASCADE,
+    period VARCHAR(8) NOT NULL CHECK (period IN ('day', 'month')),
+    quota_limit BIGINT NOT NULL CHECK (quota_limit > 0),
+    timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    used BIGINT NOT NULL DEFAULT 0 CHECK (used >= 0),
+    period_start TIMESTAMPTZ NOT NULL DEFAULT 'epoch',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (client_id, period)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER update_client_quotas_updated_at
+BEFORE UPDATE ON client_quotas
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS update_client_quotas_updated_at ON client_quotas;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS client_quotas;
+-- +goose StatementEnd
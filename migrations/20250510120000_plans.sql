@@ -0,0 +1,45 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE plans (
+    plan_id VARCHAR(255) PRIMARY KEY,
+    capacity INTEGER NOT NULL CHECK (capacity > 0),
+    rate_per_sec INTEGER NOT NULL CHECK (rate_per_sec > 0),
+    algorithm VARCHAR(32) NOT NULL DEFAULT 'token_bucket'
+        CHECK (algorithm IN ('token_bucket', 'fixed_window', 'sliding_window', 'sliding_log', 'gcra', 'leaky_bucket')),
+    window_seconds INTEGER NOT NULL DEFAULT 60 CHECK (window_seconds > 0),
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER update_plans_updated_at
+BEFORE UPDATE ON plans
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients
+    ADD COLUMN plan_id VARCHAR(255) REFERENCES plans (plan_id) ON DELETE RESTRICT,
+    ADD COLUMN overrides TEXT[] NOT NULL DEFAULT '{}';
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX clients_plan_id_idx ON clients (plan_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP COLUMN IF EXISTS overrides,
+    DROP COLUMN IF EXISTS plan_id;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS update_plans_updated_at ON plans;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP TABLE IF EXISTS plans;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients
+    ADD COLUMN parent_id VARCHAR(255) REFERENCES clients (client_id) ON DELETE RESTRICT
+        CHECK (parent_id <> client_id);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX clients_parent_id_idx ON clients (parent_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients DROP COLUMN IF EXISTS parent_id;
+-- +goose StatementEnd
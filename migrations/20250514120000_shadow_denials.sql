@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients ADD COLUMN shadow BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TABLE shadow_denials (
+    client_id VARCHAR(255) NOT NULL REFERENCES clients (client_id) ON DELETE CASCADE,
+    minute TIMESTAMPTZ NOT NULL,
+    denials BIGINT NOT NULL CHECK (denials > 0),
+    PRIMARY KEY (client_id, minute)
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX shadow_denials_minute_idx ON shadow_denials (minute);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS shadow_denials;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients DROP COLUMN IF EXISTS shadow;
+-- +goose StatementEnd
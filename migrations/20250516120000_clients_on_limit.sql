@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients
+    ADD COLUMN on_limit VARCHAR(16) NOT NULL DEFAULT 'reject' CHECK (on_limit IN ('reject', 'delay')),
+    ADD COLUMN max_delay_ms INTEGER NOT NULL DEFAULT 0 CHECK (max_delay_ms >= 0),
+    ADD COLUMN max_queued INTEGER NOT NULL DEFAULT 0 CHECK (max_queued >= 0);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- Delayed requests reserve tokens ahead of time, leaving the bucket in debt.
+ALTER TABLE clients
+    DROP CONSTRAINT clients_tokens_check,
+    ADD CONSTRAINT clients_tokens_check CHECK (tokens <= capacity);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE clients SET tokens = 0 WHERE tokens < 0;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP CONSTRAINT clients_tokens_check,
+    ADD CONSTRAINT clients_tokens_check CHECK (tokens >= 0 AND tokens <= capacity);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP COLUMN IF EXISTS on_limit,
+    DROP COLUMN IF EXISTS max_delay_ms,
+    DROP COLUMN IF EXISTS max_queued;
+-- +goose StatementEnd
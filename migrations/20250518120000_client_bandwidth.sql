@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients
+    ADD COLUMN request_bytes_per_sec INTEGER NOT NULL DEFAULT 0 CHECK (request_bytes_per_sec >= 0),
+    ADD COLUMN response_bytes_per_sec INTEGER NOT NULL DEFAULT 0 CHECK (response_bytes_per_sec >= 0);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TABLE client_usage (
+    client_id VARCHAR(255) NOT NULL REFERENCES clients (client_id) ON DELETE CASCADE,
+    minute TIMESTAMPTZ NOT NULL,
+    bytes_in BIGINT NOT NULL DEFAULT 0,
+    bytes_out BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (client_id, minute)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS client_usage;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP COLUMN IF EXISTS request_bytes_per_sec,
+    DROP COLUMN IF EXISTS response_bytes_per_sec;
+-- +goose StatementEnd
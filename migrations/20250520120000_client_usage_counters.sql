@@ -0,0 +1,46 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE client_usage RENAME COLUMN minute TO bucket_start;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE client_usage
+    ADD COLUMN granularity VARCHAR(8) NOT NULL DEFAULT 'minute' CHECK (granularity IN ('minute', 'hour')),
+    ADD COLUMN allowed BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN rejected BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN status_2xx BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN status_3xx BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN status_4xx BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN status_5xx BIGINT NOT NULL DEFAULT 0,
+    DROP CONSTRAINT client_usage_pkey,
+    ADD PRIMARY KEY (client_id, granularity, bucket_start);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+INSERT INTO client_usage (client_id, granularity, bucket_start, bytes_in, bytes_out)
+SELECT client_id, 'hour', date_trunc('hour', bucket_start), SUM(bytes_in), SUM(bytes_out)
+FROM client_usage
+GROUP BY client_id, date_trunc('hour', bucket_start);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM client_usage WHERE granularity = 'hour';
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE client_usage
+    DROP CONSTRAINT client_usage_pkey,
+    DROP COLUMN granularity,
+    DROP COLUMN allowed,
+    DROP COLUMN rejected,
+    DROP COLUMN status_2xx,
+    DROP COLUMN status_3xx,
+    DROP COLUMN status_4xx,
+    DROP COLUMN status_5xx,
+    ADD PRIMARY KEY (client_id, bucket_start);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE client_usage RENAME COLUMN bucket_start TO minute;
+-- +goose StatementEnd
@@ -0,0 +1,37 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients
+    ADD COLUMN temp_capacity INTEGER CHECK (temp_capacity > 0),
+    ADD COLUMN temp_rate_per_sec INTEGER CHECK (temp_rate_per_sec > 0),
+    ADD COLUMN temp_expires_at TIMESTAMPTZ,
+    ADD COLUMN temp_applied_by TEXT,
+    ADD COLUMN temp_applied_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+-- A temporary limit may raise the capacity, so the bucket can hold more than
+-- the client's own capacity until its next refill after the limit expires.
+ALTER TABLE clients
+    DROP CONSTRAINT clients_tokens_check,
+    ADD CONSTRAINT clients_tokens_check CHECK (tokens <= GREATEST(capacity, COALESCE(temp_capacity, 0)));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE clients SET tokens = capacity WHERE tokens > capacity;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP CONSTRAINT clients_tokens_check,
+    ADD CONSTRAINT clients_tokens_check CHECK (tokens <= capacity);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients
+    DROP COLUMN IF EXISTS temp_capacity,
+    DROP COLUMN IF EXISTS temp_rate_per_sec,
+    DROP COLUMN IF EXISTS temp_expires_at,
+    DROP COLUMN IF EXISTS temp_applied_by,
+    DROP COLUMN IF EXISTS temp_applied_at;
+-- +goose StatementEnd
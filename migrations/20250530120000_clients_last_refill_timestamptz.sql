@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients ALTER COLUMN last_refill TYPE TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients ALTER COLUMN last_refill SET DEFAULT now();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients ALTER COLUMN last_refill TYPE TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE clients ALTER COLUMN last_refill SET DEFAULT CURRENT_TIMESTAMP;
+-- +goose StatementEnd
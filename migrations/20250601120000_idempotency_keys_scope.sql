@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Keys are chosen by callers, so each admin token gets its own key space.
+ALTER TABLE idempotency_keys
+    ADD COLUMN scope TEXT NOT NULL DEFAULT '',
+    DROP CONSTRAINT idempotency_keys_pkey,
+    ADD PRIMARY KEY (scope, key);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM idempotency_keys;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE idempotency_keys
+    DROP CONSTRAINT idempotency_keys_pkey,
+    DROP COLUMN scope,
+    ADD PRIMARY KEY (key);
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE clients ADD COLUMN temp_reason TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE clients DROP COLUMN IF EXISTS temp_reason;
+-- +goose StatementEnd
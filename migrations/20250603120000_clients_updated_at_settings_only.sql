@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Settings changes bump version; token writes do not and leave updated_at as
+-- the time of the last settings change.
+DROP TRIGGER IF EXISTS update_clients_updated_at ON clients;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER update_clients_updated_at
+BEFORE UPDATE ON clients
+FOR EACH ROW
+WHEN (OLD.version IS DISTINCT FROM NEW.version)
+EXECUTE FUNCTION update_updated_at();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS update_clients_updated_at ON clients;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER update_clients_updated_at
+BEFORE UPDATE ON clients
+FOR EACH ROW
+EXECUTE FUNCTION update_updated_at();
+-- +goose StatementEnd